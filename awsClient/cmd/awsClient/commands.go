@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"awsClient/pkg/awsClient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
+)
+
+/*
+	Sous-commandes non interactives du client AWS, pour pouvoir l'utiliser
+	dans des scripts (cron, CI...). Sans sous-commande, le programme lance
+	le menu interactif habituel (cf init.go).
+*/
+
+// codes de sortie du programme
+const (
+	EXIT_OK      = 0 // la commande a réussi
+	EXIT_FAILURE = 1 // la commande a échoué
+	EXIT_USAGE   = 2 // la commande ou ses arguments sont invalides
+)
+
+// politiques possibles quand la clé existe déjà sur S3 (option -overwrite de put)
+const (
+	OVERWRITE_ALWAYS = "always" // on remplace l'objet existant
+	OVERWRITE_NEVER  = "never"  // on ne fait rien, sans erreur
+	OVERWRITE_ERROR  = "error"  // on ne fait rien et on renvoie une erreur
+)
+
+// erreur renvoyée quand les arguments d'une sous-commande sont invalides
+var errUsage = errors.New("invalid usage")
+
+// une sous-commande du client AWS
+type command struct {
+	name  string
+	usage string
+	run   func(client *client.S3EncryptionClientV3, args []string) error
+}
+
+var commands = []command{
+	{"put", "put -file <local path> -bucket <bucket> -key <key> [-overwrite always|never|error] [-create-bucket] [-workers <n>]", runPut},
+	{"get", "get -bucket <bucket> -key <key> -out <local path> [-workers <n>]", runGet},
+	{"range", "range -bucket <bucket> -key <key> -offset <offset> -length <length> [-out <local path>]", runRange},
+	{"ls", "ls [-bucket <bucket>] [-prefix <prefix>]", runList},
+	{"tree", "tree [-bucket <bucket>]", runTree},
+	{"rm", "rm -bucket <bucket> -key <key> [-r]", runRemove},
+	{"clean", "clean (-bucket <bucket> | -all)", runClean},
+	{"rewrap", "rewrap -bucket <bucket> [-prefix <prefix>]", runRewrap},
+}
+
+// affiche l'aide des sous-commandes
+func printCommandsUsage(w io.Writer) {
+	fmt.Fprintln(w, "\nCommands (without command, the interactive menu is started):")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\n", cmd.usage)
+	}
+}
+
+// exécute la sous-commande args[0] avec les arguments args[1:]
+// et renvoie le code de sortie du programme
+func runCommand(client *client.S3EncryptionClientV3, args []string) int {
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		err := cmd.run(client, args[1:])
+		if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "usage: %s\n", cmd.usage)
+			return EXIT_USAGE
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+			return EXIT_FAILURE
+		}
+		return EXIT_OK
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	printCommandsUsage(os.Stderr)
+	return EXIT_USAGE
+}
+
+// crée le FlagSet d'une sous-commande : les erreurs de parsing sont renvoyées
+// au lieu d'arrêter le programme
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parse les arguments et vérifie que les options obligatoires sont renseignées
+func parseFlags(fs *flag.FlagSet, args []string, required map[string]*string) error {
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("%w: unexpected arguments %v", errUsage, fs.Args())
+	}
+	for name, value := range required {
+		if *value == "" {
+			return fmt.Errorf("%w: -%s is required", errUsage, name)
+		}
+	}
+	return nil
+}
+
+func runPut(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("put")
+	chemin := fs.String("file", "", "local file or directory to upload")
+	bucket := fs.String("bucket", "", "destination bucket")
+	key := fs.String("key", "", "destination key in the bucket")
+	overwrite := fs.String("overwrite", OVERWRITE_ERROR, "policy when the key already exists: always, never or error")
+	createBucket := fs.Bool("create-bucket", false, "create the bucket if it does not exist")
+	workers := fs.Int("workers", awsClient.DEFAULT_WORKERS, "number of files of a directory uploaded in parallel")
+	err := parseFlags(fs, args, map[string]*string{"file": chemin, "bucket": bucket, "key": key})
+	if err != nil {
+		return err
+	}
+	if *overwrite != OVERWRITE_ALWAYS && *overwrite != OVERWRITE_NEVER && *overwrite != OVERWRITE_ERROR {
+		return fmt.Errorf("%w: unknown overwrite policy %q", errUsage, *overwrite)
+	}
+	if *workers < 1 {
+		return fmt.Errorf("%w: -workers must be at least 1", errUsage)
+	}
+	info, err := os.Stat(*chemin)
+	if err != nil {
+		return err
+	}
+
+	estPresent, err := awsClient.BucketPresent(client, *bucket)
+	if err != nil {
+		return err
+	}
+	if !estPresent {
+		if !*createBucket {
+			return fmt.Errorf("bucket %s does not exist (use -create-bucket to create it)", *bucket)
+		}
+		err = awsClient.CreerBucket(client, *bucket)
+		if err != nil {
+			return err
+		}
+	} else {
+		node, err := awsClient.TrouverObjet(client, *bucket, *key)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			switch *overwrite {
+			case OVERWRITE_NEVER:
+				fmt.Printf("%s/%s already exists, skipped\n", *bucket, *key)
+				return nil
+			case OVERWRITE_ERROR:
+				return fmt.Errorf("%s/%s already exists (use -overwrite always to replace it)", *bucket, *key)
+			}
+		}
+	}
+
+	if info.IsDir() {
+		result, err := awsClient.PutDirectory(client, *chemin, *bucket, *key, *workers)
+		fmt.Printf("%d uploaded, %d skipped, %d failed\n", result.Transferred, result.Skipped, result.Failed)
+		return err
+	}
+	_, err = awsClient.PutObject(client, *chemin, *bucket, *key)
+	return err
+}
+
+func runGet(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("get")
+	bucket := fs.String("bucket", "", "source bucket")
+	key := fs.String("key", "", "key of the file or directory to download")
+	chemin := fs.String("out", "", "local destination path (for a directory, the directory in which it is created)")
+	workers := fs.Int("workers", awsClient.DEFAULT_WORKERS, "number of files of a directory downloaded in parallel")
+	err := parseFlags(fs, args, map[string]*string{"bucket": bucket, "key": key, "out": chemin})
+	if err != nil {
+		return err
+	}
+	if *workers < 1 {
+		return fmt.Errorf("%w: -workers must be at least 1", errUsage)
+	}
+
+	root, err := awsClient.TrouverObjet(client, *bucket, *key)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return fmt.Errorf("%s/%s does not exist", *bucket, *key)
+	}
+	if !root.IsFile {
+		result, err := awsClient.GetPrefix(client, *bucket, *key, filepath.Join(*chemin, root.Name), *workers)
+		fmt.Printf("%d downloaded, %d skipped, %d failed\n", result.Transferred, result.Skipped, result.Failed)
+		return err
+	}
+	_, err = awsClient.GetObject(client, root, *chemin, *bucket, *key)
+	return err
+}
+
+func runRange(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("range")
+	bucket := fs.String("bucket", "", "source bucket")
+	key := fs.String("key", "", "key of the file")
+	offset := fs.Int64("offset", -1, "position of the first byte to read")
+	length := fs.Int64("length", -1, "number of bytes to read")
+	chemin := fs.String("out", "", "local destination path (standard output by default)")
+	err := parseFlags(fs, args, map[string]*string{"bucket": bucket, "key": key})
+	if err != nil {
+		return err
+	}
+	if *offset < 0 || *length < 0 {
+		return fmt.Errorf("%w: -offset and -length are required", errUsage)
+	}
+
+	data, err := awsClient.GetRange(client, *bucket, *key, *offset, *length)
+	if err != nil {
+		return err
+	}
+	if *chemin == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*chemin, data, 0o644)
+}
+
+func runList(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("ls")
+	bucket := fs.String("bucket", "", "list the keys of this bucket instead of the buckets")
+	prefix := fs.String("prefix", "", "only list the keys starting with this prefix")
+	err := parseFlags(fs, args, nil)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	if *bucket == "" {
+		if *prefix != "" {
+			return fmt.Errorf("%w: -prefix requires -bucket", errUsage)
+		}
+		names, err = awsClient.ListBuckets(client)
+	} else {
+		names, err = awsClient.ListKeys(client, *bucket, *prefix)
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func runTree(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("tree")
+	bucket := fs.String("bucket", "", "only print the tree of this bucket")
+	err := parseFlags(fs, args, nil)
+	if err != nil {
+		return err
+	}
+
+	if *bucket == "" {
+		return awsClient.AfficherArborescence(client)
+	}
+	return awsClient.AfficherArborescenceBucket(client, *bucket)
+}
+
+func runRemove(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("rm")
+	bucket := fs.String("bucket", "", "bucket of the object")
+	key := fs.String("key", "", "key of the object to delete")
+	recursive := fs.Bool("r", false, "delete every object under the key (directory)")
+	err := parseFlags(fs, args, map[string]*string{"bucket": bucket, "key": key})
+	if err != nil {
+		return err
+	}
+
+	if *recursive {
+		return awsClient.CleanS3Prefix(client, *bucket, strings.TrimSuffix(*key, "/")+"/")
+	}
+	node, err := awsClient.TrouverObjet(client, *bucket, *key)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return fmt.Errorf("%s/%s does not exist", *bucket, *key)
+	}
+	if !node.IsFile {
+		return fmt.Errorf("%s/%s is a directory (use -r to delete it)", *bucket, *key)
+	}
+	err = awsClient.CleanS3Object(client, *bucket, *key)
+	if err != nil {
+		return err
+	}
+	// les morceaux d'un gros fichier (cf awsClient/chunked.go)
+	return awsClient.CleanS3Prefix(client, *bucket, awsClient.ChunksPrefix(*key))
+}
+
+func runClean(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("clean")
+	bucket := fs.String("bucket", "", "delete this bucket and all its objects")
+	all := fs.Bool("all", false, "delete every bucket and all their objects")
+	err := parseFlags(fs, args, nil)
+	if err != nil {
+		return err
+	}
+
+	if *all == (*bucket != "") {
+		return fmt.Errorf("%w: exactly one of -bucket or -all is required", errUsage)
+	}
+	if *all {
+		return awsClient.CleanS3(client)
+	}
+	return awsClient.CleanS3Bucket(client, *bucket)
+}
+
+func runRewrap(client *client.S3EncryptionClientV3, args []string) error {
+	fs := newFlagSet("rewrap")
+	bucket := fs.String("bucket", "", "bucket whose objects are rewrapped with the current key slots")
+	prefix := fs.String("prefix", "", "only rewrap the keys starting with this prefix")
+	err := parseFlags(fs, args, map[string]*string{"bucket": bucket})
+	if err != nil {
+		return err
+	}
+
+	result, err := awsClient.RewrapBucket(client, *bucket, *prefix)
+	fmt.Printf("%d rewrapped, %d up to date, %d skipped, %d failed\n", result.Rewrapped, result.UpToDate, result.Skipped, result.Failed)
+	return err
+}
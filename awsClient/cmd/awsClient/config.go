@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+	hsmClient "awsClient/pkg/requestHSMclient"
+)
+
+/*
+	Configuration du client AWS : adresse du client HSM et emplacements des clés
+	sur les keystores. Elle est lue dans un fichier JSON (option -config),
+	puis les options données en ligne de commande remplacent les valeurs du fichier.
+	Exemple de fichier :
+
+	{
+	    "localstack": true,
+	    "tprf_threshold": 0,
+	    "key_version": 2,
+	    "key_cache": {"size": 128, "ttl": "5m", "max_uses": 1000},
+	    "key_reuse": {"max_objects": 1000, "max_bytes": 1073741824, "max_age": "5m"},
+	    "hsm_client": {
+	        "address": "hsm.example.org:6123",
+	        "protocol": "framed",
+	        "context_binding": true,
+	        "policy": "hedged",
+	        "hedge_delay": "150ms",
+	        "tls": {"ca": "ca.pem", "cert": "client.pem", "key": "client.key", "server_name": "hsm.example.org"}
+	    },
+	    "keys": [
+	        {"hsm": 17, "index": 1},
+	        {"hsm": 22, "index": 1, "addresses": ["hsm-a.example.org:6123", "hsm-b.example.org:6123"]},
+	        {"hsm": 23, "index": 1, "priority": 1, "weight": 2}
+	    ]
+	}
+*/
+
+type Config struct {
+	Localstack    bool            `json:"localstack"`
+	TPRFThreshold int             `json:"tprf_threshold,omitempty"` // mode TPRF si > 0 : clés dérivées par ce nombre de keystores
+	KeyVersion    int             `json:"key_version,omitempty"`    // version de la clé des emplacements, à augmenter à chaque rotation
+	KeyCache      *KeyCacheConfig `json:"key_cache,omitempty"`      // pas de cache des clés de données si absent
+	KeyReuse      *KeyReuseConfig `json:"key_reuse,omitempty"`      // une clé de données par objet si absent
+	HSMClient     HSMClientConfig `json:"hsm_client"`
+	Keys          []KeyConfig     `json:"keys"`
+}
+
+type HSMClientConfig struct {
+	Address        string     `json:"address"`
+	Protocol       string     `json:"protocol"`
+	Policy         string     `json:"policy"`                // first-success, hedged ou both-agree
+	HedgeDelay     string     `json:"hedge_delay,omitempty"` // durée ("200ms") avant d'interroger le second keystore en mode hedged
+	ContextBinding bool       `json:"context_binding"`       // ck liées à leur objet : le client HSM doit traiter les requêtes 5 et 6 (CreateCkCtx, GetKFromCKCtx)
+	TLS            *TLSConfig `json:"tls,omitempty"`         // connexion en TCP simple si absent
+}
+
+// cache des clés de données déchiffrées par le HSM (cf awsEncryptionMaterials/cache.go)
+type KeyCacheConfig struct {
+	Size    int    `json:"size,omitempty"`     // nombre maximal de clés gardées
+	TTL     string `json:"ttl,omitempty"`      // durée de vie d'une clé ("5m")
+	MaxUses int    `json:"max_uses,omitempty"` // nombre d'utilisations d'une clé (pas de limite si 0)
+}
+
+// réutilisation d'une clé de données pour plusieurs objets (cf awsEncryptionMaterials/reuse.go)
+type KeyReuseConfig struct {
+	MaxObjects int    `json:"max_objects,omitempty"` // nombre d'objets chiffrés avec une même clé
+	MaxBytes   int64  `json:"max_bytes,omitempty"`   // nombre d'octets chiffrés avec une même clé (pas de limite si 0)
+	MaxAge     string `json:"max_age,omitempty"`     // durée d'utilisation d'une clé ("5m")
+}
+
+type TLSConfig struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+}
+
+// emplacement d'une clé : numéro du keystore et index de la clé sur ce keystore.
+// les keystores de plus petite priorité sont interrogés en premier, et à priorité égale,
+// un keystore est choisi en premier proportionnellement à son poids (1 par défaut).
+// le keystore est joint par les clients HSM de Addresses (dans l'ordre de préférence),
+// ou par l'adresse hsm_client.address si la liste est vide.
+type KeyConfig struct {
+	Hsm       int      `json:"hsm"`
+	Index     int      `json:"index"`
+	Priority  int      `json:"priority,omitempty"`
+	Weight    int      `json:"weight,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// configuration utilisée quand ni le fichier ni les options ne précisent une valeur
+func DefaultConfig() Config {
+	return Config{
+		KeyVersion: MyMaterials.DEFAULT_KEY_VERSION,
+		HSMClient: HSMClientConfig{
+			Address:  "localhost:" + strconv.Itoa(HSM_CLIENT_DEFAULT_PORT),
+			Protocol: hsmClient.PROTOCOL_AUTO.String(),
+			Policy:   hsmClient.POLICY_FIRST_SUCCESS.String(),
+			// ck non liées par défaut : les clients HSM existants ne traitent que CreateCk et GetKFromCK (3 et 4)
+		},
+		Keys: []KeyConfig{
+			{Hsm: 17, Index: 1}, // keystore key17, clé à l'index 1
+			{Hsm: 22, Index: 1}, // keystore key22, clé à l'index 1
+		},
+	}
+}
+
+// lit le fichier de configuration. les valeurs absentes du fichier gardent leur valeur par défaut.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if path == "" {
+		return config, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return config, fmt.Errorf("cannot read configuration file: %w", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return config, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// lit une liste d'emplacements de clés de la forme "17:1,22:1,23:1:1:2@hsm-a:6123@hsm-b:6123"
+// (keystore:index, suivis éventuellement de :priorité et :poids, puis des adresses des clients HSM)
+func ParseKeys(value string) ([]KeyConfig, error) {
+	keys := []KeyConfig{}
+	for _, item := range strings.Split(value, ",") {
+		slot, addresses, hasAddresses := strings.Cut(strings.TrimSpace(item), "@")
+		fields := strings.Split(slot, ":")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid key slot %q (expected keystore:index[:priority[:weight]][@address...])", item)
+		}
+		numbers := make([]int, 4)
+		for i, field := range fields {
+			number, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in key slot %q", []string{"keystore number", "key index", "priority", "weight"}[i], item)
+			}
+			numbers[i] = number
+		}
+		key := KeyConfig{Hsm: numbers[0], Index: numbers[1], Priority: numbers[2], Weight: numbers[3]}
+		if hasAddresses {
+			key.Addresses = strings.Split(addresses, "@")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// renvoie les répliques de la clé au format du client HSM
+func (c Config) Replicas() []hsmClient.Replica {
+	replicas := make([]hsmClient.Replica, 0, len(c.Keys))
+	for _, key := range c.Keys {
+		replicas = append(replicas, hsmClient.Replica{
+			KeyHSM:    hsmClient.KeyHSM{Hsm_number: key.Hsm, Key_index: key.Index},
+			Priority:  key.Priority,
+			Weight:    key.Weight,
+			Addresses: key.Addresses,
+		})
+	}
+	return replicas
+}
+
+// délai avant d'interroger le second keystore en mode hedged (0 : valeur par défaut du client HSM)
+func (c Config) HedgeDelay() (time.Duration, error) {
+	if c.HSMClient.HedgeDelay == "" {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(c.HSMClient.HedgeDelay)
+	if err != nil || delay < 0 {
+		return 0, fmt.Errorf("invalid hedge delay %q", c.HSMClient.HedgeDelay)
+	}
+	return delay, nil
+}
+
+// options du cache des clés de données, nil si le cache est désactivé
+func (c Config) KeyCacheOptions() (*MyMaterials.KeyCacheOptions, error) {
+	if c.KeyCache == nil {
+		return nil, nil
+	}
+	options := &MyMaterials.KeyCacheOptions{Size: c.KeyCache.Size, MaxUses: c.KeyCache.MaxUses}
+	if c.KeyCache.TTL != "" {
+		ttl, err := time.ParseDuration(c.KeyCache.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid key cache TTL %q", c.KeyCache.TTL)
+		}
+		options.TTL = ttl
+	}
+	if options.Size < 0 || options.MaxUses < 0 {
+		return nil, fmt.Errorf("invalid key cache size %d or max uses %d", options.Size, options.MaxUses)
+	}
+	return options, nil
+}
+
+// options de réutilisation des clés de données, nil si chaque objet a sa clé
+func (c Config) KeyReuseOptions() (*MyMaterials.KeyReuseOptions, error) {
+	if c.KeyReuse == nil {
+		return nil, nil
+	}
+	options := &MyMaterials.KeyReuseOptions{MaxObjects: c.KeyReuse.MaxObjects, MaxBytes: c.KeyReuse.MaxBytes}
+	if c.KeyReuse.MaxAge != "" {
+		age, err := time.ParseDuration(c.KeyReuse.MaxAge)
+		if err != nil || age <= 0 {
+			return nil, fmt.Errorf("invalid key reuse max age %q", c.KeyReuse.MaxAge)
+		}
+		options.MaxAge = age
+	}
+	if options.MaxObjects < 0 || options.MaxBytes < 0 {
+		return nil, fmt.Errorf("invalid key reuse max objects %d or max bytes %d", options.MaxObjects, options.MaxBytes)
+	}
+	return options, nil
+}
+
+// vérifie la configuration au démarrage, pour ne pas découvrir une erreur à la première requête
+func (c Config) Validate() error {
+	_, port, err := net.SplitHostPort(c.HSMClient.Address)
+	if err != nil {
+		return fmt.Errorf("invalid HSM client address %q: %w", c.HSMClient.Address, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid HSM client port %q", port)
+	}
+	_, err = hsmClient.ParseProtocol(c.HSMClient.Protocol)
+	if err != nil {
+		return err
+	}
+	_, err = hsmClient.ParsePolicy(c.HSMClient.Policy)
+	if err != nil {
+		return err
+	}
+	if _, err := c.HedgeDelay(); err != nil {
+		return err
+	}
+	if tls := c.HSMClient.TLS; tls != nil && (tls.Cert == "") != (tls.Key == "") {
+		return fmt.Errorf("the HSM client TLS certificate and key must be given together")
+	}
+
+	// la clé doit être répliquée sur au moins deux keystores différents
+	if len(c.Keys) < 2 {
+		return fmt.Errorf("at least 2 key slots are required, got %d", len(c.Keys))
+	}
+	keystores := map[int]bool{}
+	for _, replica := range c.Replicas() {
+		if err := replica.Validate(); err != nil {
+			return err
+		}
+		if keystores[replica.Hsm_number] {
+			return fmt.Errorf("the key slots must be on different keystores (several on %d)", replica.Hsm_number)
+		}
+		keystores[replica.Hsm_number] = true
+	}
+
+	// en mode TPRF, le numéro du keystore est l'abscisse de sa part de la clé, et l'index désigne
+	// le partage de la clé : il doit être le même partout. au chiffrement, t+1 keystores sont
+	// interrogés pour vérifier que la clé pourra être retrouvée
+	if c.TPRFThreshold < 0 || c.TPRFThreshold >= len(c.Keys) {
+		return fmt.Errorf("invalid TPRF threshold %d (must be between 1 and the number of key slots minus 1, or 0 to disable)", c.TPRFThreshold)
+	}
+	if c.TPRFThreshold > 0 && keystores[0] {
+		return fmt.Errorf("keystore 0 can't be used in TPRF mode")
+	}
+	for _, key := range c.Keys {
+		if c.TPRFThreshold > 0 && key.Index != c.Keys[0].Index {
+			return fmt.Errorf("the key slots must use the same index in TPRF mode (%d on %d, %d on %d)", c.Keys[0].Index, c.Keys[0].Hsm, key.Index, key.Hsm)
+		}
+	}
+	if c.KeyVersion < 1 {
+		return fmt.Errorf("invalid key version %d (must be at least 1)", c.KeyVersion)
+	}
+	if _, err := c.KeyCacheOptions(); err != nil {
+		return err
+	}
+	if _, err := c.KeyReuseOptions(); err != nil {
+		return err
+	}
+	if c.KeyReuse != nil && c.TPRFThreshold > 0 {
+		return fmt.Errorf("the data keys can't be reused in TPRF mode")
+	}
+	return nil
+}
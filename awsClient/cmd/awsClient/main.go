@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 
 	"awsClient/pkg/awsClient"
@@ -30,6 +31,24 @@ const AWS_CREDENTIALS_PATH = ".aws/credentials"
 const AWS_CONFIG_PATH = ".aws/config"
 const LOCALSTACK_ENDPOINT = "http://localhost:4566"
 
+// indique si l'option a été donnée explicitement en ligne de commande
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// remplace la valeur de la configuration si l'option a été donnée explicitement
+func setIfFlagSet(name string, target *string, value string) {
+	if isFlagSet(name) {
+		*target = value
+	}
+}
+
 // retourne un client s3 Localstack
 func CreateS3Client_Locastack() (*s3.Client, error) {
 	// infos localstack
@@ -88,12 +107,14 @@ func CreateS3Client(localstack bool) (*s3.Client, error) {
 }
 
 // retourne un S3 encryption client
-func CreateS3EncryptionClient(hsm_client_address string, keyHSM_1 hsmClient.KeyHSM, keyHSM_2 hsmClient.KeyHSM, localstack bool) (*client.S3EncryptionClientV3, error) {
+// (les options du CMM, comme MyMaterials.WithTPRF, sont ajoutées à la fin)
+func CreateS3EncryptionClient(hsm *hsmClient.HSMClient, hsm_client_address string, replicas []hsmClient.Replica, localstack bool, cmm_options ...func(*MyMaterials.CustomCryptographicMaterialsManager)) (*client.S3EncryptionClientV3, error) {
 	s3Client, err := CreateS3Client(localstack)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create S3 client: %v", err)
 	}
-	cmm := MyMaterials.NewCustomCryptographicMaterialsManager(hsm_client_address, keyHSM_1, keyHSM_2)
+	cmm_options = append([]func(*MyMaterials.CustomCryptographicMaterialsManager){MyMaterials.WithHSMClient(hsm)}, cmm_options...)
+	cmm := MyMaterials.NewCustomCryptographicMaterialsManager(hsm_client_address, replicas, cmm_options...)
 	encryptionClient, err := client.New(s3Client, cmm)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create encryption client: %v", err)
@@ -103,37 +124,168 @@ func CreateS3EncryptionClient(hsm_client_address string, keyHSM_1 hsmClient.KeyH
 
 func main() {
 	// command-line arguments
-	hsm_client_port_flag := flag.Int("HSMclient", HSM_CLIENT_DEFAULT_PORT, "HSM client port")
+	// (ils remplacent les valeurs du fichier de configuration, cf config.go)
+	config_flag := flag.String("config", "", "JSON configuration file (HSM client, key slots...)")
+	hsm_client_port_flag := flag.Int("HSMclient", HSM_CLIENT_DEFAULT_PORT, "HSM client port (on localhost)")
+	hsm_address_flag := flag.String("HSMaddress", "", "HSM client address host:port (replaces -HSMclient)")
+	keys_flag := flag.String("keys", "", "key slots as keystore:index[:priority[:weight]][@address...] separated by commas (default 17:1,22:1)")
+	hsm_protocol_flag := flag.String("HSMprotocol", hsmClient.PROTOCOL_AUTO.String(), "protocol used to talk to the HSM client: auto (negotiated), legacy or framed")
+	hsm_policy_flag := flag.String("HSMpolicy", hsmClient.POLICY_FIRST_SUCCESS.String(), "policy of the requests to the keystores: first-success, hedged (next keystore queried after -HSMhedge) or both-agree")
+	hsm_hedge_flag := flag.String("HSMhedge", "", "delay before querying the next keystore with the hedged policy, ex: 200ms")
+	hsm_context_flag := flag.Bool("HSMcontext", false, "if true, bind the ck of each new object to its bucket/key (the HSM client must support the requests 5 and 6)")
+	hsm_tls_flag := flag.Bool("HSMtls", false, "if true, connect to the HSM client with TLS")
+	hsm_ca_flag := flag.String("HSMca", "", "PEM bundle of the CAs trusted for the HSM client certificate (system CAs by default)")
+	hsm_cert_flag := flag.String("HSMcert", "", "PEM client certificate presented to the HSM client (mutual TLS)")
+	hsm_key_flag := flag.String("HSMkey", "", "PEM private key of the client certificate")
+	hsm_server_name_flag := flag.String("HSMservername", "", "name expected in the HSM client certificate (host of the address by default)")
+	tprf_flag := flag.Int("tprf", 0, "TPRF mode: data keys derived by this number of keystores among the key slots (0: keys wrapped by the HSM)")
+	key_version_flag := flag.Int("key-version", MyMaterials.DEFAULT_KEY_VERSION, "version of the key at the key slots, recorded with the slots in every object (to increase at each key rotation, cf rewrap)")
+	key_cache_flag := flag.Int("key-cache", 0, "size of the cache of the data keys decrypted by the HSM (0: no cache, unless given in the configuration file)")
+	key_cache_ttl_flag := flag.String("key-cache-ttl", "", "lifetime of a data key in the cache, ex: 5m (default 5m)")
+	key_reuse_flag := flag.Int("key-reuse", 0, "number of objects encrypted with the same data key (0: a data key per object, unless given in the configuration file)")
+	key_reuse_age_flag := flag.String("key-reuse-age", "", "lifetime of a reused data key, ex: 5m (default 5m)")
 	localstack_flag := flag.Bool("localstack", false, "if true, the AWS client will connect to LocalStack. Otherwise (default behaviour), it will connect to a AWS account")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command [command options]]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommandsUsage(flag.CommandLine.Output())
+	}
 	flag.Parse()
-	HSM_CLIENT_ADDRESS := "localhost:" + strconv.Itoa(*hsm_client_port_flag)
-	fmt.Printf("HSM client address : %s\n", HSM_CLIENT_ADDRESS)
 
-	// keys we want to retrieve on 2 different HSM
-	keyHSM_1 := hsmClient.KeyHSM{
-		Hsm_number: 17, // keystore key17
-		Key_index:  1,  // key at index 1
+	config, err := LoadConfig(*config_flag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// seules les options données explicitement remplacent le fichier de configuration
+	if isFlagSet("HSMclient") {
+		config.HSMClient.Address = "localhost:" + strconv.Itoa(*hsm_client_port_flag)
+	}
+	setIfFlagSet("HSMaddress", &config.HSMClient.Address, *hsm_address_flag)
+	setIfFlagSet("HSMprotocol", &config.HSMClient.Protocol, *hsm_protocol_flag)
+	setIfFlagSet("HSMpolicy", &config.HSMClient.Policy, *hsm_policy_flag)
+	setIfFlagSet("HSMhedge", &config.HSMClient.HedgeDelay, *hsm_hedge_flag)
+	if isFlagSet("HSMcontext") {
+		config.HSMClient.ContextBinding = *hsm_context_flag
+	}
+	if isFlagSet("keys") {
+		config.Keys, err = ParseKeys(*keys_flag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if isFlagSet("localstack") {
+		config.Localstack = *localstack_flag
+	}
+	if isFlagSet("tprf") {
+		config.TPRFThreshold = *tprf_flag
+	}
+	if isFlagSet("key-version") {
+		config.KeyVersion = *key_version_flag
+	}
+	if isFlagSet("key-cache") {
+		if *key_cache_flag <= 0 {
+			config.KeyCache = nil
+		} else {
+			if config.KeyCache == nil {
+				config.KeyCache = &KeyCacheConfig{}
+			}
+			config.KeyCache.Size = *key_cache_flag
+		}
+	}
+	if config.KeyCache != nil {
+		setIfFlagSet("key-cache-ttl", &config.KeyCache.TTL, *key_cache_ttl_flag)
 	}
-	keyHSM_2 := hsmClient.KeyHSM{
-		Hsm_number: 22, // keystore key22
-		Key_index:  1,  // key at index 1
+	if isFlagSet("key-reuse") {
+		if *key_reuse_flag <= 0 {
+			config.KeyReuse = nil
+		} else {
+			if config.KeyReuse == nil {
+				config.KeyReuse = &KeyReuseConfig{}
+			}
+			config.KeyReuse.MaxObjects = *key_reuse_flag
+		}
 	}
+	if config.KeyReuse != nil {
+		setIfFlagSet("key-reuse-age", &config.KeyReuse.MaxAge, *key_reuse_age_flag)
+	}
+	if isFlagSet("HSMtls") {
+		if !*hsm_tls_flag {
+			config.HSMClient.TLS = nil
+		} else if config.HSMClient.TLS == nil {
+			config.HSMClient.TLS = &TLSConfig{}
+		}
+	}
+	if tls := config.HSMClient.TLS; tls != nil {
+		setIfFlagSet("HSMca", &tls.CA, *hsm_ca_flag)
+		setIfFlagSet("HSMcert", &tls.Cert, *hsm_cert_flag)
+		setIfFlagSet("HSMkey", &tls.Key, *hsm_key_flag)
+		setIfFlagSet("HSMservername", &tls.ServerName, *hsm_server_name_flag)
+	}
+	err = config.Validate()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+
+	HSM_CLIENT_ADDRESS := config.HSMClient.Address
+	fmt.Printf("HSM client address : %s\n", HSM_CLIENT_ADDRESS)
+	hsm_protocol, _ := hsmClient.ParseProtocol(config.HSMClient.Protocol)
+	hsmClient.SetProtocol(hsm_protocol)
+
+	// client qui garde les connexions au client HSM ouvertes, en TLS si demandé
+	hsm_options := hsmClient.HSMClientOptions{}
+	hsm_options.Policy, _ = hsmClient.ParsePolicy(config.HSMClient.Policy)
+	hsm_options.HedgeDelay, _ = config.HedgeDelay()
+	if tls := config.HSMClient.TLS; tls != nil {
+		hsm_options.TLSConfig, err = hsmClient.LoadTLSConfig(hsmClient.TLSOptions{
+			CAFile:     tls.CA,
+			CertFile:   tls.Cert,
+			KeyFile:    tls.Key,
+			ServerName: tls.ServerName,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	hsm := hsmClient.NewHSMClient(hsm_options)
+	defer hsm.Close()
 
-	// créer le S3 encryption client avec les informations cryptographiques ci-dessus
-	s3EncryptionClient, err := CreateS3EncryptionClient(HSM_CLIENT_ADDRESS, keyHSM_1, keyHSM_2, *localstack_flag)
+	// créer le S3 encryption client avec les répliques de la clé de la configuration
+	cmm_options := []func(*MyMaterials.CustomCryptographicMaterialsManager){MyMaterials.WithTPRF(config.TPRFThreshold), MyMaterials.WithKeyVersion(config.KeyVersion)}
+	if config.HSMClient.ContextBinding {
+		cmm_options = append(cmm_options, MyMaterials.WithContextBinding())
+	}
+	if key_cache, _ := config.KeyCacheOptions(); key_cache != nil {
+		cmm_options = append(cmm_options, MyMaterials.WithKeyCache(*key_cache))
+	}
+	if key_reuse, _ := config.KeyReuseOptions(); key_reuse != nil {
+		cmm_options = append(cmm_options, MyMaterials.WithKeyReuse(*key_reuse))
+	}
+	s3EncryptionClient, err := CreateS3EncryptionClient(hsm, HSM_CLIENT_ADDRESS, config.Replicas(), config.Localstack, cmm_options...)
 	if err != nil {
 		log.Fatal("error creating encryption client")
 	}
+	// les clés de données gardées en mémoire sont effacées à la fin du programme
+	cmm := s3EncryptionClient.Options.CryptographicMaterialsManager.(*MyMaterials.CustomCryptographicMaterialsManager)
+	defer cmm.ClearKeyCache()
+
+	// si une sous-commande est donnée, on l'exécute sans passer par le menu interactif
+	// (cf commands.go)
+	if flag.NArg() > 0 {
+		code := runCommand(s3EncryptionClient, flag.Args())
+		cmm.ClearKeyCache()
+		hsm.Close()
+		os.Exit(code)
+	}
 
 	// Une fois le mode de chiffrement décidé, on peut demander à l'utilisateur
 	// ce qu'il veut faire comme actions. cf fichier init.go
 	fmt.Println("\n*** Ce client AWS permet d'exporter et télécharger des fichiers sur S3, en réalisant un chiffrement côté client, grâce à des clés stockées sur Ethertrust. ***")
-	
+
 	// lister les actions qu'il est possible de faire pour utiliser ce programme
 	fmt.Println("\nCommandes possibles :")
 	awsClient.ListInteractions()
-	
+
 	tmp := 1
 	for tmp != 0 {
 		tmp = awsClient.InteractionConsole(s3EncryptionClient) // fonction dans init.go
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+// runs the mock HSM client (cf pkg/mockHSMclient) until Ctrl-C :
+// go run ./cmd/mockHSMclient [-port 6123] [-fault 17=hang] [-control localhost:6124]
+
+// -fault option : "17=hang", can be repeated
+type faultFlags []string
+
+func (f *faultFlags) String() string { return fmt.Sprint(*f) }
+
+func (f *faultFlags) Set(value string) error {
+	_, _, err := mockHSMclient.ParseFaultSpec(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+func main() {
+	port := flag.String("port", mockHSMclient.DEFAULT_PORT, "port the mock listens on")
+	certFile := flag.String("tls-cert", "", "PEM certificate of the mock, enables TLS")
+	keyFile := flag.String("tls-key", "", "PEM private key of the certificate")
+	clientCAFile := flag.String("tls-client-ca", "", "PEM bundle of the CAs signing the client certificates, enables mutual TLS")
+	seed := flag.String("seed", mockHSMclient.DEFAULT_SEED, "secret from which the master keys of the slots are derived")
+	tprfThreshold := flag.Int("tprf-threshold", mockHSMclient.DEFAULT_TPRF_THRESHOLD, "number of keystores needed to derive a TPRF key")
+	legacy := flag.Bool("legacy", false, "only speak the legacy protocol, closing the connection on unknown requests")
+	maxLatency := flag.Duration("max-latency", 500*time.Millisecond, "maximum random latency before each answer")
+	var faults faultFlags
+	flag.Var(&faults, "fault", "fault injected for a keystore, ex: 17=hang, 22=error:4, 17=latency:200ms:50ms (can be repeated)")
+	controlAddr := flag.String("control", "", "address of the fault control endpoint, ex: localhost:6124 (disabled if empty)")
+	flag.Parse()
+
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		var err error
+		tlsConfig, err = mockHSMclient.LoadTLSConfig(*certFile, *keyFile, *clientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *clientCAFile != "" {
+		log.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	server := mockHSMclient.NewServer(mockHSMclient.Options{
+		Addr:          net.JoinHostPort("", *port),
+		TLSConfig:     tlsConfig,
+		Seed:          []byte(*seed),
+		MaxLatency:    *maxLatency,
+		TPRFThreshold: *tprfThreshold,
+		Legacy:        *legacy,
+		Logger:        log.New(os.Stdout, "", 0),
+	})
+	for _, spec := range faults {
+		hsm_number, f, _ := mockHSMclient.ParseFaultSpec(spec)
+		server.SetFault(hsm_number, f)
+	}
+	_, err := server.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *controlAddr != "" {
+		fmt.Printf("Fault control endpoint listening at address %s...\n", *controlAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(*controlAddr, server.ControlHandler()))
+		}()
+	}
+
+	// stops cleanly on Ctrl-C
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	server.Close()
+}
@@ -28,11 +28,11 @@ func main() {
 	}
 
 	// make parallel key requests
-	key := hsmClient.GetKey(HSM_CLIENT_ADDRESS, keyHSM_1, keyHSM_2)
+	key, err := hsmClient.GetKey(HSM_CLIENT_ADDRESS, hsmClient.Replicas(keyHSM_1, keyHSM_2), "getK", nil)
 
 	// print result
-	if len(key) == 0 {
-		fmt.Println("Get key request failed.")
+	if err != nil {
+		fmt.Println("Get key request failed:", err)
 	} else {
 		fmt.Println("key :")
 		fmt.Println(key)
@@ -0,0 +1,282 @@
+package awsClient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Ce fichier gère les gros fichiers (plus de LARGE_OBJECT_SIZE octets).
+// Le S3 encryption client ne sait pas déchiffrer une partie d'un objet : un gros fichier est
+// découpé en morceaux de CHUNK_SIZE octets, envoyés comme des objets chiffrés indépendants
+// (chacun avec son vecteur d'initialisation et sa ck liée à sa propre clé S3), sous
+// "<key>.chunks/<envoi>/". L'objet "<key>" est un manifeste chiffré (JSON) qui liste les morceaux
+// avec leur taille et leur SHA-256, et porte la métadonnée CHUNKED_METADATA.
+// Au téléchargement, chaque morceau est déchiffré (le tag GCM l'authentifie), sa taille et son
+// empreinte sont comparées au manifeste, et le fichier n'apparaît que s'il est complet.
+// Un morceau remplacé, déplacé ou d'un ancien envoi est donc refusé.
+
+const (
+	LARGE_OBJECT_SIZE = 500 * 1000 * 1000 // au-delà, le fichier est découpé en morceaux
+	CHUNK_SIZE        = 64 * 1024 * 1024
+	CHUNKS_SUFFIX     = ".chunks"     // les morceaux de "<key>" sont sous "<key>.chunks/"
+	CHUNKED_METADATA  = "hsm-chunked" // métadonnée du manifeste : version du manifeste
+	MANIFEST_VERSION  = 1
+)
+
+type ChunkManifest struct {
+	Version   int     `json:"version"`
+	Size      int64   `json:"size"`
+	ChunkSize int64   `json:"chunk_size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // empreinte du morceau non chiffré, en hexadécimal
+}
+
+// préfixe des morceaux de l'objet (tous envois confondus)
+func ChunksPrefix(key string) string {
+	return key + CHUNKS_SUFFIX + "/"
+}
+
+// corps d'un morceau : l'empreinte est calculée sur les octets lus par le client, c'est-à-dire
+// ceux qui sont chiffrés et envoyés. Len donne au S3 encryption client la taille qui reste à
+// lire (il n'envoie rien, sans erreur, pour un corps de taille inconnue).
+type chunkBody struct {
+	reader io.Reader
+	size   int64
+	read   int64
+}
+
+func (b *chunkBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *chunkBody) Len() int {
+	return int(b.size - b.read)
+}
+
+// envoie un gros fichier en morceaux, puis son manifeste. les morceaux listés par le manifeste
+// remplacé sont supprimés une fois le nouveau écrit : ceux d'un envoi en cours de la même clé,
+// ou d'un envoi interrompu, ne sont pas touchés (rm supprime tous les morceaux de la clé).
+func putChunkedObject(client *client.S3EncryptionClientV3, file *os.File, size int64, bucket, key string) (*s3.PutObjectOutput, error) {
+	upload, err := MyMaterials.GenerateBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	// le manifeste remplacé est lu avant d'être écrasé
+	previous, err := previousChunks(client, bucket, key)
+	if err != nil {
+		fmt.Printf("les morceaux de l'envoi précédent de %s/%s ne seront pas supprimés : %v\n", bucket, key, err)
+	}
+	uploadPrefix := ChunksPrefix(key) + hex.EncodeToString(upload) + "/"
+	manifest := ChunkManifest{Version: MANIFEST_VERSION, Size: size, ChunkSize: CHUNK_SIZE}
+	for offset, index := int64(0), 0; offset < size; offset, index = offset+CHUNK_SIZE, index+1 {
+		chunk := Chunk{
+			Key:  fmt.Sprintf("%s%06d", uploadPrefix, index),
+			Size: min(CHUNK_SIZE, size-offset),
+		}
+		sum := sha256.New()
+		body := &chunkBody{reader: io.TeeReader(io.NewSectionReader(file, offset, chunk.Size), sum), size: chunk.Size}
+
+		ctx := MyMaterials.WithObjectContext(context.TODO(), bucket, chunk.Key)
+		ctx = MyMaterials.WithObjectSize(ctx, chunk.Size)
+		_, err = client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(chunk.Key),
+			Body:   body,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("échec de l'envoi du morceau %d de %s/%s : %w", index, bucket, key, err)
+		}
+		// un fichier raccourci pendant l'envoi donne un morceau plus petit que prévu
+		if body.read != chunk.Size {
+			return nil, fmt.Errorf("échec de l'envoi du morceau %d de %s/%s : %d octets lus au lieu de %d", index, bucket, key, body.read, chunk.Size)
+		}
+		chunk.SHA256 = hex.EncodeToString(sum.Sum(nil))
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		fmt.Printf("morceau %d/%d envoyé\n", index+1, (size+CHUNK_SIZE-1)/CHUNK_SIZE)
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	ctx := MyMaterials.WithObjectContext(context.TODO(), bucket, key)
+	ctx = MyMaterials.WithObjectSize(ctx, int64(len(body)))
+	out, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(body),
+		Metadata: map[string]string{CHUNKED_METADATA: strconv.Itoa(MANIFEST_VERSION)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("échec de l'envoi du manifeste de %s/%s : %w", bucket, key, err)
+	}
+
+	// les morceaux du manifeste remplacé ne sont plus référencés
+	err = nil
+	for _, old := range previous {
+		if !strings.HasPrefix(old, uploadPrefix) {
+			err = errors.Join(err, CleanS3Object(client, bucket, old))
+		}
+	}
+	if err != nil {
+		fmt.Printf("les anciens morceaux de %s/%s n'ont pas pu être supprimés : %v\n", bucket, key, err)
+	}
+	return out, nil
+}
+
+// renvoie les clés des morceaux listés par le manifeste actuel de l'objet
+// (aucune si l'objet n'existe pas ou n'est pas un gros fichier)
+func previousChunks(client *client.S3EncryptionClientV3, bucket, key string) ([]string, error) {
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, chunked := head.Metadata[CHUNKED_METADATA]; !chunked {
+		return nil, nil
+	}
+	manifest, err := getChunkManifest(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(manifest.Chunks))
+	for _, chunk := range manifest.Chunks {
+		keys = append(keys, chunk.Key)
+	}
+	return keys, nil
+}
+
+// lit et vérifie le manifeste d'un gros fichier
+func getChunkManifest(client *client.S3EncryptionClientV3, bucket, key string) (*ChunkManifest, error) {
+	ctx := MyMaterials.WithObjectContext(context.TODO(), bucket, key)
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("erreur avec appel de GetObject : %w", err)
+	}
+	defer out.Body.Close()
+	manifest := &ChunkManifest{}
+	err = json.NewDecoder(out.Body).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("manifeste de %s/%s invalide : %w", bucket, key, err)
+	}
+	if manifest.Version != MANIFEST_VERSION {
+		return nil, fmt.Errorf("version %d du manifeste de %s/%s non supportée", manifest.Version, bucket, key)
+	}
+	total := int64(0)
+	for _, chunk := range manifest.Chunks {
+		if !strings.HasPrefix(chunk.Key, ChunksPrefix(key)) || chunk.Size < 0 || len(chunk.SHA256) != 2*sha256.Size {
+			return nil, fmt.Errorf("manifeste de %s/%s invalide : morceau %q", bucket, key, chunk.Key)
+		}
+		total += chunk.Size
+	}
+	if total != manifest.Size {
+		return nil, fmt.Errorf("manifeste de %s/%s invalide : %d octets dans les morceaux au lieu de %d", bucket, key, total, manifest.Size)
+	}
+	return manifest, nil
+}
+
+// télécharge un gros fichier : les morceaux sont déchiffrés et vérifiés un par un,
+// et écrits à la suite dans le fichier
+func getChunkedObject(client *client.S3EncryptionClientV3, chemin, bucket, key string) error {
+	manifest, err := getChunkManifest(client, bucket, key)
+	if err != nil {
+		return err
+	}
+	reader := &chunkReader{client: client, bucket: bucket, chunks: manifest.Chunks}
+	defer reader.Close()
+	err = writeFileAtomic(chemin, reader, manifest.Size)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Téléchargé %d octets (%d morceaux) depuis S3 et écrit dans %s\n", manifest.Size, len(manifest.Chunks), chemin)
+	return nil
+}
+
+// lit les morceaux du manifeste les uns après les autres. à la fin de chaque morceau,
+// sa taille et son empreinte sont vérifiées : un morceau modifié donne une erreur de lecture.
+type chunkReader struct {
+	client *client.S3EncryptionClientV3
+	bucket string
+	chunks []Chunk
+
+	body io.ReadCloser // morceau en cours, nil entre deux morceaux
+	sum  hash.Hash
+	read int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			ctx := MyMaterials.WithObjectContext(context.TODO(), r.bucket, r.chunks[0].Key)
+			out, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(r.bucket),
+				Key:    aws.String(r.chunks[0].Key),
+			})
+			if err != nil {
+				return 0, fmt.Errorf("échec de la récupération du morceau %s : %w", r.chunks[0].Key, err)
+			}
+			r.body, r.sum, r.read = out.Body, sha256.New(), 0
+		}
+		n, err := r.body.Read(p)
+		r.sum.Write(p[:n])
+		r.read += int64(n)
+		if r.read > r.chunks[0].Size {
+			return n, fmt.Errorf("le morceau %s ne correspond pas au manifeste", r.chunks[0].Key)
+		}
+		if err == io.EOF {
+			chunk := r.chunks[0]
+			r.body.Close()
+			r.body, r.chunks = nil, r.chunks[1:]
+			if r.read != chunk.Size || hex.EncodeToString(r.sum.Sum(nil)) != chunk.SHA256 {
+				return n, fmt.Errorf("le morceau %s ne correspond pas au manifeste", chunk.Key)
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package awsClient
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// écrit un fichier de la taille donnée
+func writeTestFile(t *testing.T, size int) (*os.File, []byte) {
+	t.Helper()
+	data := testData(size)
+	chemin := filepath.Join(t.TempDir(), "gros")
+	if err := os.WriteFile(chemin, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(chemin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file, data
+}
+
+func TestPutChunkedObject(t *testing.T) {
+	if testing.Short() {
+		t.Skip("envoie plus de CHUNK_SIZE octets")
+	}
+	client, fake := newTestClient(t)
+	file, data := writeTestFile(t, CHUNK_SIZE+10)
+	// un autre envoi de la même clé, pas encore terminé
+	putBytes(t, client, "bucket", "gros", []byte("petit"), nil)
+	other := ChunksPrefix("gros") + "autre/000000"
+	putBytes(t, client, "bucket", other, []byte("en cours"), nil)
+
+	download := func() []byte {
+		t.Helper()
+		chemin := filepath.Join(t.TempDir(), "gros")
+		if _, err := GetObject(client, &Node{Name: "gros", IsFile: true}, chemin, "bucket", "gros"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(chemin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	uploads := [][]string{}
+	for range 2 {
+		if _, err := putChunkedObject(client, file, int64(len(data)), "bucket", "gros"); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(download(), data) {
+			t.Fatal("fichier téléchargé différent")
+		}
+		manifest, err := getChunkManifest(client, "bucket", "gros")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Chunks) != 2 || manifest.Chunks[0].Size != CHUNK_SIZE || manifest.Chunks[1].Size != 10 {
+			t.Fatalf("morceaux inattendus %+v", manifest.Chunks)
+		}
+		keys := []string{}
+		for _, chunk := range manifest.Chunks {
+			keys = append(keys, chunk.Key)
+		}
+		uploads = append(uploads, keys)
+	}
+
+	// seuls les morceaux du manifeste remplacé ont été supprimés
+	stored := fake.keys("bucket", ChunksPrefix("gros"))
+	for _, key := range uploads[0] {
+		if slices.Contains(stored, key) {
+			t.Errorf("morceau %s de l'envoi remplacé toujours là", key)
+		}
+	}
+	for _, key := range append(uploads[1], other) {
+		if !slices.Contains(stored, key) {
+			t.Errorf("morceau %s supprimé", key)
+		}
+	}
+	if len(stored) != 3 {
+		t.Fatalf("morceaux %v", stored)
+	}
+}
+
+// un fichier raccourci pendant l'envoi est refusé, sans écrire de manifeste
+func TestPutChunkedObjectShortFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("envoie plus de CHUNK_SIZE octets")
+	}
+	client, fake := newTestClient(t)
+	file, data := writeTestFile(t, CHUNK_SIZE+10)
+	if err := os.Truncate(file.Name(), CHUNK_SIZE-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := putChunkedObject(client, file, int64(len(data)), "bucket", "gros"); err == nil {
+		t.Fatal("fichier raccourci envoyé")
+	}
+	if fake.object("bucket", "gros") != nil {
+		t.Fatal("manifeste écrit")
+	}
+}
@@ -3,25 +3,26 @@ package awsClient
 import (
 	"context"
 	"fmt"
-	"log"
 
 	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 //Ce fichier permet de supprimer récursivement tous les objects de S3
 
 // On commence par parcourir tous les buckets puis pour chaque bucket on supprime tous ses objets
-func CleanS3(client *client.S3EncryptionClientV3) {
-	listOut, err := client.ListBuckets(context.TODO(), nil)
+func CleanS3(client *client.S3EncryptionClientV3) error {
+	buckets, err := ListBuckets(client)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	listBuckets := listOut.Buckets
-	for _, bucket := range listBuckets {
-		CleanS3Bucket(client, *aws.String(*bucket.Name))
+	for _, bucket := range buckets {
+		err = CleanS3Bucket(client, bucket)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // On parcourt tous les objects d'un buckets et on les supprime
@@ -57,6 +58,21 @@ func CleanS3Bucket(client *client.S3EncryptionClientV3, bucketName string) error
 	return nil
 }
 
+// On supprime tous les objets dont la clé commence par le préfixe donné (sans supprimer le bucket)
+func CleanS3Prefix(client *client.S3EncryptionClientV3, bucketName, prefix string) error {
+	keys, err := ListKeys(client, bucketName, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = CleanS3Object(client, bucketName, key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func CleanS3Object(client *client.S3EncryptionClientV3, bucketName, objectKey string) error {
 	// Créer une requête pour supprimer un objet
 	input := &s3.DeleteObjectInput{
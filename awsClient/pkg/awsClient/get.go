@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -14,7 +15,6 @@ import (
 
 	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
@@ -44,77 +44,134 @@ func GetObject(client *client.S3EncryptionClientV3, root *Node, chemin, bucket,
 		// fmt.Printf("taille fichier : %d octets\n", int(*headObject.ContentLength))
 
 		ctx := context.TODO()
-		ctx = context.WithValue(ctx, MyMaterials.FavContextKey("x"), []byte(bucket+"/"+key))
-		fmt.Println(MyMaterials.FavContextKey("x"))
-		// cas d'un gros fichier (on utilise alors le downloader, similairement avec le PUT et l'uploader)
-		// TODO : ça marche pas, erreur "clé inconnue"
-		if int(*headObject.ContentLength) > 500*1000*1000 {
-			downloader := manager.NewDownloader(client, func(u *manager.Downloader) { // ici on prend un *client.S3EncryptionClientV3
-				u.PartSize = 10 * 1024 * 1024 // 1MB per part
-			})
-
-			// création d'un fichier
-			file, err := os.Create(chemin)
-			if err != nil {
-				return nil, fmt.Errorf("erreur lors de la création du fichier local : %w", err)
-			}
-			defer file.Close()
-
-			// download
-			fmt.Printf("clé :\"%s\"\n", key)
-			numBytesDownloaded, err := downloader.Download(ctx, file, &s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(key),
-			})
-			if err != nil {
-				fmt.Println("Erreur lors du download multipart :", err)
-				return nil, err
-			}
-
-			fmt.Printf("Téléchargé %d bytes depuis S3 et écrit dans %s\n", numBytesDownloaded, chemin)
-			return nil, nil
-
+		ctx = MyMaterials.WithObjectContext(ctx, bucket, key)
+		// cas d'un gros fichier : l'objet est le manifeste de ses morceaux (cf chunked.go)
+		if _, chunked := headObject.Metadata[CHUNKED_METADATA]; chunked {
+			return nil, getChunkedObject(client, chemin, bucket, key)
 		} else { // cas d'un petit fichier (on fait un simple GET)
 			out, err := client.GetObject(ctx, &s3.GetObjectInput{
 				Bucket: aws.String(bucket),
 				Key:    aws.String(key),
 			})
 			if err != nil {
-				log.Fatalf("erreur avec appel de GetObject\n")
+				return nil, fmt.Errorf("erreur avec appel de GetObject : %w", err)
 			}
-			meta := out.Metadata
-			// On récupère dans les métadonnées du fichier sa taille
-			taille, err := strconv.Atoi(meta["x-amz-unencrypted-content-length"])
-			if err != nil {
-				log.Fatalf("Problème dans la récupération de la taille du fichier: %v", err)
-			}
-			// on crée un fichier de cette taille
-			p := make([]byte, taille)
-			Body := out.Body
-			_, err = Body.Read(p)
-			if err != nil {
-				log.Fatalf("%v", err)
+			defer out.Body.Close()
+			// la taille donnée dans les métadonnées sert seulement à vérifier le fichier écrit
+			taille := int64(-1)
+			if value, ok := out.Metadata[UNENCRYPTED_LENGTH_METADATA]; ok {
+				taille, err = strconv.ParseInt(value, 10, 64)
+				if err != nil || taille < 0 {
+					return nil, fmt.Errorf("taille du fichier invalide dans les métadonnées : %q", value)
+				}
 			}
-			err = os.WriteFile(chemin, p[:], 0o666)
+			err = writeFileAtomic(chemin, out.Body, taille)
 			if err != nil {
-				log.Fatalf("problème dans l'écriture du fichier%v", err)
+				return nil, err
 			}
-			return out, err
+			return out, nil
 		}
 	} else {
-		// Cas dossier : on crée un nouveau dossier et on appelle récursivement la fonction GetObject
-		fmt.Println("cas 2")
-		newPath := chemin + "/" + root.Name
-		err := os.Mkdir(newPath, 0o666)
-		if err != nil {
-			return nil, err
+		// Cas dossier : les objets sous la clé sont téléchargés en parallèle dans un dossier du même nom
+		result, err := GetPrefix(client, bucket, key, chemin+"/"+root.Name, DEFAULT_WORKERS)
+		fmt.Printf("%d récupérés, %d ignorés, %d en échec\n", result.Transferred, result.Skipped, result.Failed)
+		return nil, err
+	}
+}
+
+// télécharge les objets dont la clé commence par "prefix/" (tout le bucket si prefix est vide)
+// dans le dossier chemin, en recréant les sous-dossiers, avec au plus workers téléchargements
+// en parallèle. les morceaux d'un gros fichier sont récupérés avec son manifeste (cf chunked.go).
+// une clé qui sortirait du dossier ("../") est ignorée. un objet en échec n'arrête pas les autres.
+func GetPrefix(client *client.S3EncryptionClientV3, bucket, prefix, chemin string, workers int) (TransferResult, error) {
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	keys, err := ListKeys(client, bucket, prefix)
+	if err != nil {
+		return TransferResult{}, err
+	}
+	objects := map[string]bool{}
+	for _, key := range keys {
+		objects[key] = true
+	}
+
+	tasks := []transferTask{}
+	skipped := 0
+	for _, key := range keys {
+		if manifest, _, found := strings.Cut(key, CHUNKS_SUFFIX+"/"); found && objects[manifest] {
+			continue
 		}
-		for newKey, newRoot := range root.Children {
-			newPath = newPath + newKey
-			GetObject(client, newRoot, newPath, bucket, key+"/"+newKey)
+		// les "dossiers" créés par la console S3 sont des objets vides dont la clé finit par "/"
+		rel := strings.TrimPrefix(key, prefix)
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			continue
 		}
-		return nil, err
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			fmt.Printf("%s/%s ignoré : la clé sort du dossier %s\n", bucket, key, chemin)
+			skipped++
+			continue
+		}
+		path := filepath.Join(chemin, filepath.FromSlash(rel))
+		tasks = append(tasks, transferTask{
+			name: bucket + "/" + key,
+			run: func() error {
+				err := os.MkdirAll(filepath.Dir(path), 0o755)
+				if err != nil {
+					return err
+				}
+				_, err = GetObject(client, &Node{Name: filepath.Base(path), IsFile: true}, path, bucket, key)
+				return err
+			},
+		})
+	}
+
+	result := runTransfers(tasks, workers)
+	result.Skipped = skipped
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d files couldn't be downloaded", result.Failed)
 	}
+	return result, nil
+}
+
+// métadonnée où le S3 encryption client range la taille du fichier non chiffré
+const UNENCRYPTED_LENGTH_METADATA = "x-amz-unencrypted-content-length"
+
+// écrit le contenu déchiffré dans un fichier temporaire à côté de chemin, puis le renomme en chemin :
+// le fichier n'apparaît que s'il est complet, et il n'est jamais entièrement en mémoire.
+// si taille n'est pas -1, le nombre d'octets écrits doit être celui-là.
+func writeFileAtomic(chemin string, body io.Reader, taille int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(chemin), "."+filepath.Base(chemin)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("problème dans la création du fichier: %w", err)
+	}
+	// le fichier temporaire est supprimé en cas d'erreur (sans effet après le renommage)
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, body)
+	if err != nil {
+		return fmt.Errorf("problème dans la lecture du fichier: %w", err)
+	}
+	if taille >= 0 && n != taille {
+		return fmt.Errorf("fichier tronqué : %d octets reçus au lieu de %d", n, taille)
+	}
+	// CreateTemp crée le fichier en 0600 : on lui donne les droits habituels d'un fichier
+	err = tmp.Chmod(0o644)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("problème dans l'écriture du fichier: %w", err)
+	}
+	err = os.Rename(tmp.Name(), chemin)
+	if err != nil {
+		return fmt.Errorf("problème dans l'écriture du fichier: %w", err)
+	}
+	return nil
 }
 
 func traiterGet(client *client.S3EncryptionClientV3, reader *bufio.Reader) (*s3.GetObjectOutput, error) {
@@ -147,9 +204,13 @@ func traiterGet(client *client.S3EncryptionClientV3, reader *bufio.Reader) (*s3.
 		return nil, err
 	}
 	key = strings.TrimSuffix(key, "\n")
-	estPresent, root := inAWSS3(client, bucket, key)
+	estPresent, root, err := inAWSS3(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
 	if !estPresent {
-		fmt.Println("le fichier n'existe pas")
+		fmt.Println("le fichier n'existe pas, l'action Get ne sera pas effectuée")
+		return nil, nil
 	}
 	fmt.Println("Veuillez indiquer l'emplacement (local) désiré pour le fichier/dossier")
 	chemin, err := reader.ReadString('\n')
@@ -33,11 +33,11 @@ func InteractionConsole(client *client.S3EncryptionClientV3) int {
 	} else if char == 'X' {
 		return 0
 	} else if char == 'L' {
-		traiterList(client) // cf tools.go
+		err = traiterList(client) // cf tools.go
 	} else if char == 'A' {
-		AfficherArborescence(client) // cf tree.go
+		err = AfficherArborescence(client) // cf tree.go
 	} else if char == 'D' {
-		CleanS3(client) // cf clean.go
+		err = CleanS3(client) // cf clean.go
 	} else if char == 'H' {
 		ListInteractions()
 	} else {
@@ -4,8 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"log"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -13,7 +14,6 @@ import (
 
 	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
@@ -35,41 +35,23 @@ func PutObject(client *client.S3EncryptionClientV3, chemin, bucket, key string)
 		// fmt.Println("avant la lecture du fichier")
 		file, err := os.Open(chemin)
 		if err != nil {
-			log.Fatalf("error lecture fichier: %v", err)
+			return nil, fmt.Errorf("erreur lecture fichier: %w", err)
 		}
+		defer file.Close()
 		// En fait le contexte ici est une donnée qui sera transmise au Cryptographic Materials manager (cf mymaterials/cmm.go)
-		// Concrètement, on lui donne ici une valeur x, cette valeur n'est pas utile dans le cas de la connexion via le serveur HSM
-		// Cependant elle est essentielle pour le protocole TPRF
-		// Dans notre cas, il faudrait remplacer la valeur x par l'indice i (entier) de l'emplacement mémoire de la clé sur l'HSM
+		// Concrètement, on lui donne ici l'objet (bucket/key) : la ck est liée à cet objet par le HSM,
+		// et en mode TPRF la clé de données est dérivée de l'objet par les keystores (cf awsEncryptionMaterials/tprf.go)
 		// Remarque : Il faut aussi s'assurer que les clés ne changent pas de place sur HSM et qu'elles ne sont pas effacées sinon le fichier est perdue
 		ctx := context.TODO()
-		ctx = context.WithValue(ctx, MyMaterials.FavContextKey("x"), []byte(bucket+"/"+key))
+		ctx = MyMaterials.WithObjectContext(ctx, bucket, key)
+		// la taille compte dans la limite d'octets chiffrés avec une même clé (cf awsEncryptionMaterials/reuse.go)
+		ctx = MyMaterials.WithObjectSize(ctx, info.Size())
 
 		// fmt.Println("juste avant le test de la taille")
-		// cas d'un gros fichier
-		if info.Size() > 500*1000*1000 {
+		// cas d'un gros fichier : il est envoyé en morceaux chiffrés séparément (cf chunked.go)
+		if info.Size() > LARGE_OBJECT_SIZE {
 			fmt.Println("gros fichier !")
-
-			// Create an uploader with the client and custom options
-			uploader := manager.NewUploader(client, func(u *manager.Uploader) {
-				u.PartSize = 10 * 1024 * 1024 // 1MB per part
-			})
-
-			// Lancer l'upload avec le chiffrement via EncryptionClient
-			result, err := uploader.Upload(ctx, &s3.PutObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    aws.String(key),
-				Body:   file,
-			})
-			if err != nil {
-				fmt.Println("Erreur lors de l'upload multipart :", err)
-				return nil, err
-			}
-
-			// TODO : gérer le cas de la sortie de l'upload
-
-			fmt.Println("Upload multipart complété avec succès:", result.Location)
-			return nil, nil
+			return putChunkedObject(client, file, info.Size(), bucket, key)
 		} else {
 			// cas d'un petit fichier
 			// Explication de PUT:
@@ -90,19 +72,57 @@ func PutObject(client *client.S3EncryptionClientV3, chemin, bucket, key string)
 		}
 
 	} else {
-		// Cas d'un dossier : la requête est traitée récursivement
-		files, err := os.ReadDir(chemin)
+		// Cas d'un dossier : les fichiers sont envoyés en parallèle
+		result, err := PutDirectory(client, chemin, bucket, key, DEFAULT_WORKERS)
+		fmt.Printf("%d envoyés, %d ignorés, %d en échec\n", result.Transferred, result.Skipped, result.Failed)
+		return nil, err
+	}
+}
+
+// envoie les fichiers du dossier et de ses sous-dossiers, avec au plus workers envois en parallèle.
+// la clé d'un fichier est key suivie de son chemin dans le dossier. les liens symboliques et
+// les fichiers spéciaux sont ignorés. un fichier en échec n'arrête pas les autres.
+func PutDirectory(client *client.S3EncryptionClientV3, chemin, bucket, key string, workers int) (TransferResult, error) {
+	tasks := []transferTask{}
+	skipped := 0
+	err := filepath.WalkDir(chemin, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			return nil, err
+			return err
 		}
-		for _, file := range files {
-			PutObject(client, chemin+"/"+file.Name(), bucket, key+"/"+file.Name())
+		if entry.IsDir() {
+			return nil
 		}
-		return nil, err
+		if !entry.Type().IsRegular() {
+			fmt.Printf("%s ignoré : ce n'est pas un fichier\n", path)
+			skipped++
+			return nil
+		}
+		rel, err := filepath.Rel(chemin, path)
+		if err != nil {
+			return err
+		}
+		objectKey := key + "/" + filepath.ToSlash(rel)
+		tasks = append(tasks, transferTask{
+			name: path,
+			run: func() error {
+				_, err := PutObject(client, path, bucket, objectKey)
+				return err
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return TransferResult{Skipped: skipped}, fmt.Errorf("erreur lors du parcours de %s : %w", chemin, err)
+	}
+
+	result := runTransfers(tasks, workers)
+	result.Skipped = skipped
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d files couldn't be uploaded", result.Failed)
 	}
+	return result, nil
 }
 
-// TODO : gérer le cas des dossiers - faire des requetes parallèles ?
 func traiterPut(client *client.S3EncryptionClientV3, reader *bufio.Reader) (*s3.PutObjectOutput, error) {
 	// Idem : On récupère les infos de l'utilisateur pour appeller notre fonction
 	fmt.Println("Vous avez demandé à mettre un fichier sur amazon S3 !")
@@ -0,0 +1,115 @@
+package awsClient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Ce fichier permet de lire une partie d'un objet chiffré.
+// Pour un gros fichier (cf chunked.go), seuls les morceaux qui couvrent la partie demandée sont
+// téléchargés, et chacun est authentifié (tag GCM, taille et SHA-256 du manifeste) avant d'être lu.
+// Un objet chiffré en un seul morceau doit être téléchargé en entier pour être authentifié :
+// seule la partie demandée est gardée.
+
+var ErrInvalidRange = errors.New("invalid range")
+
+// renvoie length octets de l'objet à partir de offset (moins si l'objet se termine avant)
+func GetRange(client *client.S3EncryptionClientV3, bucket, key string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("%w: offset %d, length %d", ErrInvalidRange, offset, length)
+	}
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, chunked := head.Metadata[CHUNKED_METADATA]; chunked {
+		return getChunkedRange(client, bucket, key, offset, length)
+	}
+
+	ctx := MyMaterials.WithObjectContext(context.TODO(), bucket, key)
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("erreur avec appel de GetObject : %w", err)
+	}
+	defer out.Body.Close()
+	if _, err := io.CopyN(io.Discard, out.Body, offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: offset %d after the end of %s/%s", ErrInvalidRange, offset, bucket, key)
+		}
+		return nil, err
+	}
+	data := &bytes.Buffer{}
+	if _, err := io.CopyN(data, out.Body, length); err != nil && err != io.EOF {
+		return nil, err
+	}
+	// la fin de l'objet est lue pour que le déchiffrement vérifie le tag
+	if _, err := io.Copy(io.Discard, out.Body); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// lit la partie demandée dans les morceaux qui la couvrent
+func getChunkedRange(client *client.S3EncryptionClientV3, bucket, key string, offset, length int64) ([]byte, error) {
+	manifest, err := getChunkManifest(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if offset > manifest.Size {
+		return nil, fmt.Errorf("%w: offset %d after the end of %s/%s (%d bytes)", ErrInvalidRange, offset, bucket, key, manifest.Size)
+	}
+	end := offset + min(length, manifest.Size-offset)
+	data := make([]byte, 0, end-offset)
+	start := int64(0) // position du morceau dans l'objet
+	for _, chunk := range manifest.Chunks {
+		if start < end && start+chunk.Size > offset {
+			content, err := getChunk(client, bucket, chunk)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, content[max(offset-start, 0):min(end-start, chunk.Size)]...)
+		}
+		start += chunk.Size
+	}
+	return data, nil
+}
+
+// télécharge un morceau et vérifie qu'il correspond au manifeste
+func getChunk(client *client.S3EncryptionClientV3, bucket string, chunk Chunk) ([]byte, error) {
+	ctx := MyMaterials.WithObjectContext(context.TODO(), bucket, chunk.Key)
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(chunk.Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("échec de la récupération du morceau %s : %w", chunk.Key, err)
+	}
+	defer out.Body.Close()
+	// un morceau plus grand que prévu est refusé sans être lu en entier
+	content, err := io.ReadAll(io.LimitReader(out.Body, chunk.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("échec de la récupération du morceau %s : %w", chunk.Key, err)
+	}
+	sum := sha256.Sum256(content)
+	if int64(len(content)) != chunk.Size || hex.EncodeToString(sum[:]) != chunk.SHA256 {
+		return nil, fmt.Errorf("le morceau %s ne correspond pas au manifeste", chunk.Key)
+	}
+	return content, nil
+}
@@ -0,0 +1,133 @@
+package awsClient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// envoie un objet chiffré
+func putBytes(t *testing.T, client *client.S3EncryptionClientV3, bucket, key string, data []byte, metadata map[string]string) {
+	t.Helper()
+	ctx := MyMaterials.WithObjectContext(context.TODO(), bucket, key)
+	ctx = MyMaterials.WithObjectSize(ctx, int64(len(data)))
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(data),
+		Metadata: metadata,
+	})
+	if err != nil {
+		t.Fatalf("PutObject %s/%s : %v", bucket, key, err)
+	}
+}
+
+// envoie data en morceaux de chunkSize octets sous "<key>.chunks/<upload>/", puis leur manifeste
+func putSmallChunks(t *testing.T, client *client.S3EncryptionClientV3, bucket, key, upload string, data []byte, chunkSize int) ChunkManifest {
+	t.Helper()
+	manifest := ChunkManifest{Version: MANIFEST_VERSION, Size: int64(len(data)), ChunkSize: int64(chunkSize)}
+	for index, offset := 0, 0; offset < len(data); index, offset = index+1, offset+chunkSize {
+		content := data[offset:min(offset+chunkSize, len(data))]
+		sum := sha256.Sum256(content)
+		chunk := Chunk{Key: fmt.Sprintf("%s%s/%06d", ChunksPrefix(key), upload, index), Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
+		putBytes(t, client, bucket, chunk.Key, content, nil)
+		manifest.Chunks = append(manifest.Chunks, chunk)
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBytes(t, client, bucket, key, body, map[string]string{CHUNKED_METADATA: strconv.Itoa(MANIFEST_VERSION)})
+	return manifest
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestGetRange(t *testing.T) {
+	client, _ := newTestClient(t)
+	data := testData(25)
+	putBytes(t, client, "bucket", "simple", data, nil)
+	putSmallChunks(t, client, "bucket", "gros", "0001", data, 10)
+
+	tests := []struct {
+		offset, length int64
+		want           []byte
+	}{
+		{0, 25, data},
+		{0, 5, data[:5]},
+		{8, 4, data[8:12]},   // à cheval sur deux morceaux
+		{5, 17, data[5:22]},  // sur trois morceaux
+		{20, 100, data[20:]}, // au-delà de la fin
+		{10, 10, data[10:20]},
+		{25, 3, []byte{}},
+		{3, 0, []byte{}},
+	}
+	for _, key := range []string{"simple", "gros"} {
+		for _, test := range tests {
+			got, err := GetRange(client, "bucket", key, test.offset, test.length)
+			if err != nil || !bytes.Equal(got, test.want) {
+				t.Errorf("GetRange(%s, %d, %d) = %v, %v, want %v", key, test.offset, test.length, got, err, test.want)
+			}
+		}
+		for _, invalid := range [][2]int64{{26, 1}, {-1, 1}, {0, -1}} {
+			if _, err := GetRange(client, "bucket", key, invalid[0], invalid[1]); !errors.Is(err, ErrInvalidRange) {
+				t.Errorf("GetRange(%s, %d, %d) : got %v, want ErrInvalidRange", key, invalid[0], invalid[1], err)
+			}
+		}
+	}
+}
+
+// un morceau échangé avec un autre est refusé, à la lecture d'une partie comme du fichier entier
+func TestChunksTampered(t *testing.T) {
+	client, fake := newTestClient(t)
+	data := testData(25)
+	manifest := putSmallChunks(t, client, "bucket", "gros", "0001", data, 10)
+	dir := t.TempDir()
+	root := &Node{Name: "gros", IsFile: true}
+	if _, err := GetObject(client, root, filepath.Join(dir, "ok"), "bucket", "gros"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "ok")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("fichier téléchargé différent (%v)", err)
+	}
+
+	// même taille, mais contenu d'un autre morceau (rechiffré sous le bon nom)
+	putBytes(t, client, "bucket", manifest.Chunks[1].Key, data[:10], nil)
+	if _, err := GetRange(client, "bucket", "gros", 12, 2); err == nil {
+		t.Fatal("morceau modifié accepté par GetRange")
+	}
+	if _, err := GetObject(client, root, filepath.Join(dir, "modifié"), "bucket", "gros"); err == nil {
+		t.Fatal("morceau modifié accepté par GetObject")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "modifié")); !os.IsNotExist(err) {
+		t.Fatalf("fichier incomplet écrit (%v)", err)
+	}
+
+	// un morceau copié sous un autre nom ne se déchiffre pas
+	fake.mu.Lock()
+	fake.objects["bucket/"+manifest.Chunks[1].Key] = fake.objects["bucket/"+manifest.Chunks[0].Key]
+	fake.mu.Unlock()
+	if _, err := GetRange(client, "bucket", "gros", 12, 2); !errors.Is(err, MyMaterials.ErrContextMismatch) {
+		t.Fatalf("got %v, want ErrContextMismatch", err)
+	}
+}
@@ -0,0 +1,172 @@
+package awsClient
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Ce fichier permet de rechiffrer les ck des objets d'un bucket après une rotation de la clé du HSM
+// (cf awsEncryptionMaterials/rotation.go) : seules les métadonnées des objets sont réécrites,
+// par une copie de l'objet sur lui-même, le contenu chiffré n'est ni téléchargé ni renvoyé.
+
+// métadonnées de l'objet où le S3 encryption client range la material description,
+// la clé chiffrée et l'algorithme de protection de la clé
+const (
+	MATDESC_METADATA    = "x-amz-matdesc"
+	CIPHER_KEY_METADATA = "x-amz-key-v2"
+	WRAP_ALG_METADATA   = "x-amz-wrap-alg"
+)
+
+// taille maximale d'un objet copié en une seule requête CopyObject
+const MAX_COPY_SIZE = 5 * 1024 * 1024 * 1024
+
+// bilan d'un rewrap
+type RewrapResult struct {
+	Rewrapped int // objets dont la ck a été rechiffrée
+	UpToDate  int // objets déjà chiffrés avec la clé courante
+	Skipped   int // objets non chiffrés, ou en mode TPRF
+	Failed    int // objets dont le rechiffrement a échoué
+}
+
+// parcourt les objets du bucket (sous le préfixe s'il est donné), et rechiffre les ck
+// avec les emplacements et la version de clé du CMM du client.
+// un objet en échec n'arrête pas le parcours : l'erreur est affichée et comptée.
+func RewrapBucket(client *client.S3EncryptionClientV3, bucket, prefix string) (RewrapResult, error) {
+	result := RewrapResult{}
+	cmm, ok := client.Options.CryptographicMaterialsManager.(*MyMaterials.CustomCryptographicMaterialsManager)
+	if !ok {
+		return result, fmt.Errorf("the encryption client doesn't use the HSM cryptographic materials manager")
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return result, fmt.Errorf("échec de la pagination : %w", err)
+		}
+		for _, obj := range page.Contents {
+			rewrapped, err := RewrapObject(client, cmm, bucket, *obj.Key)
+			switch {
+			case errors.Is(err, errNotEncrypted) || errors.Is(err, MyMaterials.ErrRewrapUnsupported):
+				fmt.Printf("%s/%s ignoré : %v\n", bucket, *obj.Key, err)
+				result.Skipped++
+			case err != nil:
+				fmt.Printf("échec du rechiffrement de %s/%s : %v\n", bucket, *obj.Key, err)
+				result.Failed++
+			case rewrapped:
+				fmt.Printf("%s/%s rechiffré\n", bucket, *obj.Key)
+				result.Rewrapped++
+			default:
+				result.UpToDate++
+			}
+		}
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("the ck of %d objects couldn't be rewrapped", result.Failed)
+	}
+	return result, nil
+}
+
+var errNotEncrypted = errors.New("object not encrypted by the client")
+
+// rechiffre la ck d'un objet et réécrit sa material description.
+// renvoie false si l'objet était déjà chiffré avec la clé courante.
+func RewrapObject(client *client.S3EncryptionClientV3, cmm *MyMaterials.CustomCryptographicMaterialsManager, bucket, key string) (bool, error) {
+	ctx := context.TODO()
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+	if _, ok := head.Metadata[MATDESC_METADATA]; !ok {
+		return false, errNotEncrypted
+	}
+	// les valeurs sont réécrites par la copie : elles sont décodées, et pas seulement la material description
+	metadata := map[string]string{}
+	for name, value := range head.Metadata {
+		metadata[name], err = decodeS3Metadata(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid metadata %s: %w", name, err)
+		}
+	}
+	cipherKey, err := base64.StdEncoding.DecodeString(metadata[CIPHER_KEY_METADATA])
+	if err != nil {
+		return false, fmt.Errorf("invalid encrypted key in the metadata: %w", err)
+	}
+	wrapped, changed, err := cmm.Rewrap(ctx, MyMaterials.WrappedKey{MatDesc: metadata[MATDESC_METADATA], CipherKey: cipherKey})
+	if err != nil || !changed {
+		return false, err
+	}
+	if aws.ToInt64(head.ContentLength) > MAX_COPY_SIZE {
+		return false, fmt.Errorf("object of %d bytes too large to be copied in place", aws.ToInt64(head.ContentLength))
+	}
+
+	// copie de l'objet sur lui-même avec les nouvelles métadonnées. la copie n'a lieu
+	// que si l'objet n'a pas changé depuis qu'on a lu sa material description.
+	// avec MetadataDirectiveReplace, S3 ne garde que ce qui est donné : les en-têtes
+	// et le stockage de l'objet (classe, chiffrement côté serveur) sont repris de head.
+	metadata[MATDESC_METADATA] = wrapped.MatDesc
+	metadata[CIPHER_KEY_METADATA] = base64.StdEncoding.EncodeToString(wrapped.CipherKey)
+	metadata[WRAP_ALG_METADATA] = MyMaterials.WRAP_ALG_CK
+	_, err = client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(bucket + "/" + key)),
+		CopySourceIfMatch: head.ETag,
+		Metadata:          metadata,
+		MetadataDirective: types.MetadataDirectiveReplace,
+		ContentType:       head.ContentType,
+
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+
+		StorageClass:         head.StorageClass,
+		ServerSideEncryption: head.ServerSideEncryption,
+		SSEKMSKeyId:          head.SSEKMSKeyId,
+		BucketKeyEnabled:     head.BucketKeyEnabled,
+	})
+	if err != nil {
+		return false, fmt.Errorf("couldn't rewrite the metadata: %w", err)
+	}
+	return true, nil
+}
+
+// S3 renvoie une valeur de métadonnée non ASCII en "encoded-word" MIME (RFC 2047), après avoir lu
+// ses octets UTF-8 comme du latin-1. la valeur d'origine est retrouvée comme le fait le
+// S3 encryption client pour la material description (customS3Decoder) : chaque caractère
+// du texte décodé est un octet de la valeur.
+func decodeS3Metadata(value string) (string, error) {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil || decoded == value {
+		return decoded, err
+	}
+	original := make([]byte, 0, len(decoded))
+	for _, r := range decoded {
+		if r > 0xFF {
+			// pas un double encodage
+			return decoded, nil
+		}
+		original = append(original, byte(r))
+	}
+	return string(original), nil
+}
@@ -0,0 +1,93 @@
+package awsClient
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestDecodeS3Metadata(t *testing.T) {
+	for _, value := range []string{"", "simple", `{"ctx":"bucket/dossier/été.txt"}`, "Hélène ✓"} {
+		got, err := decodeS3Metadata(s3EncodeHeader(value))
+		if err != nil || got != value {
+			t.Errorf("decodeS3Metadata(%q) = %q, %v, want %q", s3EncodeHeader(value), got, err, value)
+		}
+	}
+	if _, err := decodeS3Metadata("=?ISO-2022-JP?B?GyRCJUYlOSVIGyhC?="); err == nil {
+		t.Error("unknown charset accepted")
+	}
+}
+
+// après une rotation, la ck d'un objet au nom accentué est rechiffrée avec la nouvelle clé,
+// et la copie garde les métadonnées, les en-têtes et le stockage de l'objet
+func TestRewrapObject(t *testing.T) {
+	addr := startMockHSM(t)
+	fake, endpoint := newFakeS3(t)
+	before := newEncryptionClient(t, endpoint, newTestCMM(t, addr, 1))
+	cmm := newTestCMM(t, addr, 2, MyMaterials.WithKeyVersion(2))
+	after := newEncryptionClient(t, endpoint, cmm)
+
+	key := "dossier/été.txt"
+	ctx := MyMaterials.WithObjectContext(context.TODO(), "bucket", key)
+	_, err := before.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String("bucket"),
+		Key:                aws.String(key),
+		Body:               strings.NewReader("contenu"),
+		Metadata:           map[string]string{"auteur": "Hélène"},
+		CacheControl:       aws.String("max-age=60"),
+		ContentDisposition: aws.String("attachment"),
+		ContentEncoding:    aws.String("identity"),
+		ContentLanguage:    aws.String("fr"),
+		StorageClass:       types.StorageClassStandardIa,
+
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		SSEKMSKeyId:          aws.String("alias/test"),
+		BucketKeyEnabled:     aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := fake.object("bucket", key).header.Clone()
+
+	rewrapped, err := RewrapObject(after, cmm, "bucket", key)
+	if err != nil || !rewrapped {
+		t.Fatalf("RewrapObject = %v, %v", rewrapped, err)
+	}
+	copied := fake.object("bucket", key).header
+	for name := range stored {
+		if name == "X-Amz-Meta-X-Amz-Matdesc" || name == "X-Amz-Meta-X-Amz-Key-V2" {
+			continue
+		}
+		if copied.Get(name) != stored.Get(name) {
+			t.Errorf("%s : %q après la copie, %q avant", name, copied.Get(name), stored.Get(name))
+		}
+	}
+	md := MyMaterials.WrappedKey{MatDesc: copied.Get("X-Amz-Meta-X-Amz-Matdesc")}
+	if _, changed, err := cmm.Rewrap(context.TODO(), md); err != nil || changed {
+		t.Fatalf("material description non mise à jour : %q (%v)", md.MatDesc, err)
+	}
+
+	// l'objet se déchiffre avec la nouvelle clé, et n'est plus à rechiffrer
+	out, err := after.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := io.ReadAll(out.Body); err != nil || string(content) != "contenu" {
+		t.Fatalf("contenu %q (%v)", content, err)
+	}
+	out.Body.Close()
+	if out.Metadata["auteur"] != s3EncodeHeader("Hélène") {
+		t.Errorf("métadonnée auteur %q", out.Metadata["auteur"])
+	}
+	rewrapped, err = RewrapObject(after, cmm, "bucket", key)
+	if err != nil || rewrapped {
+		t.Fatalf("second RewrapObject = %v, %v", rewrapped, err)
+	}
+}
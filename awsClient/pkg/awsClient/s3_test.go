@@ -0,0 +1,230 @@
+package awsClient
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	MyMaterials "awsClient/pkg/awsEncryptionMaterials"
+	"awsClient/pkg/mockHSMclient"
+	hsmClient "awsClient/pkg/requestHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// faux S3 en mémoire : objets, métadonnées, listes, copies et suppressions (en style path)
+
+type fakeObject struct {
+	body   []byte
+	header http.Header // métadonnées (x-amz-meta-*) et en-têtes gardés par S3
+	etag   string
+}
+
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject // "<bucket>/<key>"
+}
+
+// en-têtes d'un PUT ou d'une copie gardés avec l'objet, en plus des métadonnées
+var storedHeaders = []string{
+	"Content-Type", "Cache-Control", "Content-Encoding", "Content-Disposition", "Content-Language",
+	"X-Amz-Storage-Class", "X-Amz-Server-Side-Encryption", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Server-Side-Encryption-Bucket-Key-Enabled",
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	f := &fakeS3{objects: map[string]*fakeObject{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	switch {
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copyObject(w, r, path)
+	case r.Method == http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := md5.Sum(body)
+		f.objects[path] = &fakeObject{body: body, header: keptHeaders(r.Header), etag: `"` + hex.EncodeToString(sum[:]) + `"`}
+		w.Header().Set("ETag", f.objects[path].etag)
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.listObjects(w, bucket, r.URL.Query().Get("prefix"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range object.header {
+			for _, value := range values {
+				w.Header().Add(name, s3EncodeHeader(value))
+			}
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.body)))
+		if r.Method == http.MethodGet {
+			w.Write(object.body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func keptHeaders(header http.Header) http.Header {
+	kept := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") || slices.Contains(storedHeaders, name) {
+			kept[name] = values
+		}
+	}
+	return kept
+}
+
+// comme S3, une valeur non ASCII est renvoyée en "encoded-word" MIME, après avoir été lue
+// octet par octet comme du latin-1 (le double encodage que défait le S3 encryption client)
+func s3EncodeHeader(value string) string {
+	ascii := true
+	runes := make([]rune, 0, len(value))
+	for _, b := range []byte(value) {
+		ascii = ascii && b < 0x80
+		runes = append(runes, rune(b))
+	}
+	if ascii {
+		return value
+	}
+	return mime.BEncoding.Encode("UTF-8", string(runes))
+}
+
+func (f *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, path string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	object, ok := f.objects[strings.TrimPrefix(source, "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != object.etag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	header := object.header
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		header = keptHeaders(r.Header)
+	}
+	f.objects[path] = &fakeObject{body: object.body, header: header, etag: object.etag}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", object.etag)
+}
+
+func (f *fakeS3) listObjects(w http.ResponseWriter, bucket, prefix string) {
+	type content struct{ Key string }
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		KeyCount int
+		Contents []content
+	}{Name: bucket}
+	for path := range f.objects {
+		if b, key, _ := strings.Cut(path, "/"); b == bucket && strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{key})
+		}
+	}
+	slices.SortFunc(result.Contents, func(a, b content) int { return strings.Compare(a.Key, b.Key) })
+	result.KeyCount = len(result.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// clés des objets du bucket sous le préfixe
+func (f *fakeS3) keys(bucket, prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for path := range f.objects {
+		if b, key, _ := strings.Cut(path, "/"); b == bucket && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (f *fakeS3) object(bucket, key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[bucket+"/"+key]
+}
+
+// lance un faux client HSM sur un port libre de localhost, arrêté à la fin du test
+func startMockHSM(t *testing.T) string {
+	t.Helper()
+	server := mockHSMclient.NewServer(mockHSMclient.Options{})
+	addr, err := server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return addr
+}
+
+// CMM qui utilise le faux client HSM à addr, avec la clé d'indice index des keystores 17 et 22
+// (objets liés à leur nom)
+func newTestCMM(t *testing.T, addr string, index int, optFns ...func(*MyMaterials.CustomCryptographicMaterialsManager)) *MyMaterials.CustomCryptographicMaterialsManager {
+	t.Helper()
+	hsm := hsmClient.NewHSMClient(hsmClient.HSMClientOptions{})
+	t.Cleanup(func() { hsm.Close() })
+	replicas := hsmClient.Replicas(hsmClient.KeyHSM{Hsm_number: 17, Key_index: index}, hsmClient.KeyHSM{Hsm_number: 22, Key_index: index})
+	optFns = append([]func(*MyMaterials.CustomCryptographicMaterialsManager){MyMaterials.WithHSMClient(hsm), MyMaterials.WithContextBinding()}, optFns...)
+	return MyMaterials.NewCustomCryptographicMaterialsManager(addr, replicas, optFns...)
+}
+
+// client de chiffrement sur le faux S3 à endpoint
+func newEncryptionClient(t *testing.T, endpoint string, cmm *MyMaterials.CustomCryptographicMaterialsManager) *client.S3EncryptionClientV3 {
+	t.Helper()
+	s3Client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+	})
+	encryptionClient, err := client.New(s3Client, cmm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryptionClient
+}
+
+// client de chiffrement sur un nouveau faux S3, avec un CMM sur un nouveau faux client HSM
+func newTestClient(t *testing.T, optFns ...func(*MyMaterials.CustomCryptographicMaterialsManager)) (*client.S3EncryptionClientV3, *fakeS3) {
+	t.Helper()
+	fake, endpoint := newFakeS3(t)
+	return newEncryptionClient(t, endpoint, newTestCMM(t, startMockHSM(t), 1, optFns...)), fake
+}
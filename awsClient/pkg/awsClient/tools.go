@@ -15,15 +15,31 @@ import (
 // Fonctions générales pour intéragir avec S3, utilisées par nos autres fichiers.go
 
 // Cette fonction permet de regarder si un fichier est présent déja dans un bucket
-func inAWSS3(client *client.S3EncryptionClientV3, bucket, path string) (bool, *Node) {
-	root := auxArbo(client, bucket)
+func inAWSS3(client *client.S3EncryptionClientV3, bucket, path string) (bool, *Node, error) {
+	root, err := auxArbo(client, bucket)
+	if err != nil {
+		return false, nil, err
+	}
 	estPresent, newRoot := inTree(bucket+"/"+path, root)
-	return estPresent, newRoot
+	return estPresent, newRoot, nil
+}
+
+// Version exportée de inAWSS3 : renvoie le noeud (fichier ou dossier) associé à la clé,
+// ou nil si la clé n'existe pas dans le bucket
+func TrouverObjet(client *client.S3EncryptionClientV3, bucket, key string) (*Node, error) {
+	estPresent, root, err := inAWSS3(client, bucket, key)
+	if err != nil || !estPresent {
+		return nil, err
+	}
+	return root, nil
 }
 
 // Regarde si un dossier est présent et si ce n'est pas le cas propose de le créer
 func verifierDossier(client *client.S3EncryptionClientV3, bucket, sous_rep string) (int, error) {
-	estPresent, _ := inAWSS3(client, bucket, sous_rep)
+	estPresent, _, err := inAWSS3(client, bucket, sous_rep)
+	if err != nil {
+		return 0, err
+	}
 	if estPresent {
 		return 2, nil
 	} else {
@@ -47,7 +63,11 @@ func verifierDossier(client *client.S3EncryptionClientV3, bucket, sous_rep strin
 
 // Regarde si un fichier (associé à un chemin) est présent, si c'est déja le cas, propose de le remplacer
 func verifierKey(client *client.S3EncryptionClientV3, bucket, key string) int {
-	estPresent, _ := inAWSS3(client, bucket, key)
+	estPresent, _, err := inAWSS3(client, bucket, key)
+	if err != nil {
+		fmt.Println("Impossible de vérifier la présence du fichier :", err)
+		return 0
+	}
 	if estPresent {
 		fmt.Printf("Il y a déjà un fichier avec ce nom dans le bucket %s. L'action de Put remplacera le fichier (ou modifira le dossier). ", bucket)
 		fmt.Print("Voulez-vous continuer ? (O/N)  ")
@@ -70,17 +90,41 @@ func verifierKey(client *client.S3EncryptionClientV3, bucket, key string) int {
 
 // Vérifier si un bucket est présent ou pas
 func bucketPresent(client *client.S3EncryptionClientV3, bucket string) bool {
-	listOut, _ := client.ListBuckets(context.TODO(), nil)
-	listBuckets := listOut.Buckets
-	var estPresent bool = false
-	for _, buck := range listBuckets {
-		if *buck.Name == bucket {
-			estPresent = true
-		}
+	estPresent, err := BucketPresent(client, bucket)
+	if err != nil {
+		fmt.Println("Impossible de lister les buckets :", err)
 	}
 	return estPresent
 }
 
+// Version exportée de bucketPresent, qui renvoie l'erreur au lieu de l'afficher
+func BucketPresent(client *client.S3EncryptionClientV3, bucket string) (bool, error) {
+	buckets, err := ListBuckets(client)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range buckets {
+		if name == bucket {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Crée un bucket (dans la région eu-west-3)
+func CreerBucket(client *client.S3EncryptionClientV3, bucket string) error {
+	_, err := client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
+		Bucket: aws.String(bucket),
+		CreateBucketConfiguration: &types.CreateBucketConfiguration{
+			LocationConstraint: "eu-west-3",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("échec de la création du bucket %s: %w", bucket, err)
+	}
+	return nil
+}
+
 // Cette fonction vérifie que le bucket est présent, si ce n'est pas le cas, demande à l'utilisateur s'il veut crée le bucket
 func verifierBucket(client *client.S3EncryptionClientV3, bucket string) (int, error) {
 	estPresent := bucketPresent(client, bucket)
@@ -101,12 +145,7 @@ func verifierBucket(client *client.S3EncryptionClientV3, bucket string) (int, er
 			fmt.Println("1)Votre nom de bucket doit être unique- Autrement dit, aucune autre personne dans le monde doit avoir un bucket ayant le même nom")
 			fmt.Println("2)Votre bucket doit faire entre 3 et 63 caractères")
 			fmt.Println("Seules les lettres minuscules les chiffres et les tirets \"-\" sont autorisés")
-			_, err = client.CreateBucket(context.TODO(), &s3.CreateBucketInput{
-				Bucket: aws.String(bucket),
-				CreateBucketConfiguration: &types.CreateBucketConfiguration{
-					LocationConstraint: "eu-west-3",
-				},
-			})
+			err = CreerBucket(client, bucket)
 			return 1, err
 		} else if char == 'N' {
 			return 0, nil
@@ -117,11 +156,49 @@ func verifierBucket(client *client.S3EncryptionClientV3, bucket string) (int, er
 	}
 }
 
+// Renvoie le nom de tous les buckets de l'utilisateur
+func ListBuckets(client *client.S3EncryptionClientV3) ([]string, error) {
+	listOut, err := client.ListBuckets(context.TODO(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("échec du listage des buckets : %w", err)
+	}
+	buckets := make([]string, 0, len(listOut.Buckets))
+	for _, bucket := range listOut.Buckets {
+		buckets = append(buckets, *bucket.Name)
+	}
+	return buckets, nil
+}
+
+// Renvoie toutes les clés présentes dans un bucket sous un préfixe donné
+func ListKeys(client *client.S3EncryptionClientV3, bucket, prefix string) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("échec de la pagination : %w", err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+		}
+	}
+	return keys, nil
+}
+
 // Fonction pour afficher tous les buckets de l'utilisateur
-func traiterList(client *client.S3EncryptionClientV3) {
-	listOut, _ := client.ListBuckets(context.TODO(), nil)
-	listBuckets := listOut.Buckets
-	for _, bucket := range listBuckets {
-		fmt.Println(*bucket.Name)
+func traiterList(client *client.S3EncryptionClientV3) error {
+	buckets, err := ListBuckets(client)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		fmt.Println(bucket)
 	}
+	return nil
 }
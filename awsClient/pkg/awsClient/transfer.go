@@ -0,0 +1,59 @@
+package awsClient
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Ce fichier répartit les transferts des fichiers d'un dossier entre plusieurs goroutines
+// (cf PutDirectory et GetPrefix). Un fichier en échec n'arrête pas les autres : l'erreur est affichée et comptée.
+
+// nombre de transferts en parallèle quand aucun n'est donné
+const DEFAULT_WORKERS = 8
+
+// bilan du transfert d'un dossier
+type TransferResult struct {
+	Transferred int // fichiers envoyés ou téléchargés
+	Skipped     int // entrées ignorées (liens symboliques, fichiers spéciaux, clés hors du dossier...)
+	Failed      int // fichiers dont le transfert a échoué
+}
+
+// transfert d'un fichier : name est affiché en cas d'échec
+type transferTask struct {
+	name string
+	run  func() error
+}
+
+// exécute les transferts avec au plus workers goroutines (DEFAULT_WORKERS si workers <= 0)
+func runTransfers(tasks []transferTask, workers int) TransferResult {
+	if workers <= 0 {
+		workers = DEFAULT_WORKERS
+	}
+	result := TransferResult{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan transferTask)
+	for i := 0; i < min(workers, len(tasks)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				err := task.run()
+				mu.Lock()
+				if err != nil {
+					fmt.Printf("échec du transfert de %s : %v\n", task.name, err)
+					result.Failed++
+				} else {
+					result.Transferred++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+	return result
+}
@@ -3,7 +3,6 @@ package awsClient
 import (
 	"context"
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/aws/amazon-s3-encryption-client-go/v3/client"
@@ -52,7 +51,7 @@ func printTree(node *Node, indent string) {
 }
 
 // Cette fonction permet d'afficher tous les sous dossiers d'un bucket
-func auxArbo(client *client.S3EncryptionClientV3, bucket string) *Node {
+func auxArbo(client *client.S3EncryptionClientV3, bucket string) (*Node, error) {
 	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 	}
@@ -61,28 +60,38 @@ func auxArbo(client *client.S3EncryptionClientV3, bucket string) *Node {
 	for paginator.HasMorePages() {
 		output, err := paginator.NextPage(context.TODO())
 		if err != nil {
-			log.Fatalf("failed to list objects, %v", err)
+			return nil, fmt.Errorf("failed to list objects of bucket %s: %w", bucket, err)
 		}
 		for _, object := range output.Contents {
 			addNode(root, *object.Key)
 		}
 	}
-	return root
+	return root, nil
 }
 
-// On affiche chaque bucket via les deux fonctions précédentes
-func AfficherArborescence(client *client.S3EncryptionClientV3) {
-	listOut, err := client.ListBuckets(context.TODO(), nil)
+// Affiche l'arborescence d'un seul bucket
+func AfficherArborescenceBucket(client *client.S3EncryptionClientV3, bucket string) error {
+	root, err := auxArbo(client, bucket)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	printTree(root, "")
+	return nil
+}
 
-	listBuckets := listOut.Buckets
-	//fmt.Printf("%d\n", len(listBuckets))
-	for _, bucket := range listBuckets {
-		//fmt.Println(*bucket.Name)
-		printTree(auxArbo(client, *bucket.Name), "")
+// On affiche chaque bucket via les deux fonctions précédentes
+func AfficherArborescence(client *client.S3EncryptionClientV3) error {
+	buckets, err := ListBuckets(client)
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		err = AfficherArborescenceBucket(client, bucket)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // Recherche récursive d'un chemin dans l'arbre
@@ -1,11 +1,11 @@
 package awsEncryptionMaterials
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
-	"encoding/hex"
+	"crypto/subtle"
 	"fmt"
-	"math/big"
 
 	hsmClient "awsClient/pkg/requestHSMclient"
 
@@ -22,6 +22,7 @@ const (
 	// gcmKeySize         = 32
 	gcmNonceSize      = 12
 	EncryptionContext = "EncryptionContext"
+	CK_SIZE           = 48 // taille d'une ck créée par le HSM
 )
 
 type CustomCryptographicMaterialsManager struct {
@@ -29,24 +30,102 @@ type CustomCryptographicMaterialsManager struct {
 	// - l'adresse du client HSM, qui est capable de récupérer les clés sur le HSM
 	hsm_client_address string
 	// - les infos le la clé qu'il va utiliser
-	// on lui passe deux structures hsmClient.KeyHSM
+	// on lui passe les répliques de la clé (hsmClient.Replica)
 	// qui donnent le couple (numéro du keystore, index de la clé)
-	// ce qui permet de référencer deux endroits où se situe la clé
-	keyHSM_1 hsmClient.KeyHSM
-	keyHSM_2 hsmClient.KeyHSM
+	// ce qui permet de référencer les endroits où se situe la clé,
+	// avec la priorité et le poids de chaque keystore
+	replicas []hsmClient.Replica
+	// - le client qui garde des connexions ouvertes vers le client HSM
+	// (hsmClient.DefaultHSMClient() par défaut)
+	hsm *hsmClient.HSMClient
+	// - en mode TPRF, le seuil t : la clé de données est dérivée par t keystores (cf tprf.go).
+	// 0 : la clé est chiffrée par le HSM en une ck
+	tprf_threshold int
+	// - la version de la clé des répliques, enregistrée avec leurs emplacements
+	// dans la material description (cf rotation.go)
+	key_version int
+	// - le cache des clés de données déchiffrées par le HSM (cf cache.go), nil si désactivé
+	cache *keyCache
+	// - la clé de données réutilisée pour plusieurs objets (cf reuse.go), nil si désactivé
+	reuse *keyReuse
+	// - si vrai, la ck est liée par le HSM à l'objet du contexte (cf WithContextBinding)
+	bind_context bool
 }
 
 type FavContextKey string
 
+// clé du contexte sous laquelle PutObject et GetObject rangent l'objet ("bucket/key")
+const OBJECT_CONTEXT_KEY = FavContextKey("x")
+
+// clé de la material description où est gardé le contexte lié à la ck
+const MATDESC_CONTEXT_KEY = "ctx"
+
+// ajoute au contexte l'objet (bucket/key) à lier au matériel de chiffrement
+func WithObjectContext(ctx context.Context, bucket string, key string) context.Context {
+	return context.WithValue(ctx, OBJECT_CONTEXT_KEY, []byte(bucket+"/"+key))
+}
+
+// option du CMM : la ck de chaque objet est liée par le HSM à l'objet (bucket/key) donné par
+// WithObjectContext, et l'objet est enregistré dans la material description : un objet copié ou
+// déplacé vers une autre clé S3 ne peut plus être déchiffré.
+// le client HSM doit savoir traiter les requêtes CreateCkCtx et GetKFromCKCtx (codes 5 et 6).
+// sans cette option, les ck sont créées par CreateCk (code 3) et ne sont liées à aucun objet.
+// les objets déjà liés sont déchiffrés avec leur contexte, que l'option soit donnée ou non.
+func WithContextBinding() func(*CustomCryptographicMaterialsManager) {
+	return func(ccm *CustomCryptographicMaterialsManager) {
+		ccm.bind_context = true
+	}
+}
+
+// récupère l'objet (bucket/key) rangé dans le contexte par WithObjectContext
+func ObjectContext(ctx context.Context) ([]byte, bool) {
+	objectContext, ok := ctx.Value(OBJECT_CONTEXT_KEY).([]byte)
+	return objectContext, ok && len(objectContext) > 0
+}
+
+// vérifie que l'objet du contexte est celui auquel la material description a été liée au chiffrement.
+// renvoie l'objet, et false si la material description n'est liée à aucun objet
+func checkObjectContext(ctx context.Context, md materials.MaterialDescription) ([]byte, bool, error) {
+	boundContext, bound := md[MATDESC_CONTEXT_KEY]
+	if !bound {
+		return nil, false, nil
+	}
+	objectContext, ok := ObjectContext(ctx)
+	if !ok {
+		return nil, true, fmt.Errorf("%w: object encrypted for %q, no object given", ErrContextMismatch, boundContext)
+	}
+	if subtle.ConstantTimeCompare(objectContext, []byte(boundContext)) != 1 {
+		return nil, true, fmt.Errorf("%w: object encrypted for %q, decrypted as %q", ErrContextMismatch, boundContext, objectContext)
+	}
+	return objectContext, true, nil
+}
+
 // crée un cryptographic material manager qui s'occupe de gérer le matériel de chiffrement
 // pour le S3 encryption client.
 // on lui passe l'adresse du client HSM pour faire des requêtes de clés,
-// et deux addresse de la clé qu'on veut sur des keystores différents
-func NewCustomCryptographicMaterialsManager(hsm_client_address string, keyHSM_1 hsmClient.KeyHSM, keyHSM_2 hsmClient.KeyHSM) *CustomCryptographicMaterialsManager {
-	return &CustomCryptographicMaterialsManager{
+// et les répliques de la clé qu'on veut sur des keystores différents
+// (hsmClient.Replicas(keyHSM_1, keyHSM_2) si elles ont toutes la même priorité).
+// les options (WithHSMClient...) permettent de modifier le comportement par défaut
+func NewCustomCryptographicMaterialsManager(hsm_client_address string, replicas []hsmClient.Replica, optFns ...func(*CustomCryptographicMaterialsManager)) *CustomCryptographicMaterialsManager {
+	ccm := &CustomCryptographicMaterialsManager{
 		hsm_client_address: hsm_client_address,
-		keyHSM_1:           keyHSM_1,
-		keyHSM_2:           keyHSM_2,
+		replicas:           replicas,
+		key_version:        DEFAULT_KEY_VERSION,
+	}
+	for _, fn := range optFns {
+		fn(ccm)
+	}
+	if ccm.hsm == nil {
+		ccm.hsm = hsmClient.DefaultHSMClient()
+	}
+	return ccm
+}
+
+// option du CMM : utilise le client HSM donné pour les requêtes de clés
+// (pour partager le pool de connexions, ou choisir ses options)
+func WithHSMClient(hsm *hsmClient.HSMClient) func(*CustomCryptographicMaterialsManager) {
+	return func(ccm *CustomCryptographicMaterialsManager) {
+		ccm.hsm = hsm
 	}
 }
 
@@ -62,41 +141,58 @@ func GenerateBytes(n int) ([]byte, error) {
 // Fonctions utilisées pour le chiffrement/déchiffrement
 func (ccm *CustomCryptographicMaterialsManager) GetEncryptionMaterials(ctx context.Context, matDesc materials.MaterialDescription) (*materials.CryptographicMaterials, error) {
 	// ici on envoie une requête au client HSM, qui va récupérer la clé stockée aux emplacements
-	// donnés en entrée. Cette fonction fait deux requêtes parallèles et renvoie le résultat
-	// de la première requête qui a terminé.
-	k := make([]byte, 32)
-	_, err := rand.Read(k)
+	// donnés en entrée. Les keystores sont interrogés selon la politique du client HSM
+	// (par défaut, requêtes parallèles et résultat de la première requête qui a réussi).
+	if ccm.tprf_threshold > 0 {
+		return ccm.getEncryptionMaterialsTPRF(ctx)
+	}
+	// avec WithContextBinding, si l'objet (bucket/key) est dans le contexte, la ck y est liée par le HSM :
+	// elle ne pourra être déchiffrée qu'avec le même contexte.
+	// une ck réutilisée pour plusieurs objets est liée à leur bucket
+	objectContext, bound := ObjectContext(ctx)
+	if !ccm.bind_context {
+		objectContext, bound = nil, false
+	}
+	var k, key, ckContext []byte
+	var err error
+	if ccm.reuse != nil {
+		k, key, ckContext, err = ccm.reusedKey(ctx, objectContext)
+	} else {
+		k, key, ckContext, err = ccm.newDataKey(ctx, objectContext)
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	// fmt.Printf("Un nombre random %x\n", k)
-	key := hsmClient.GetKey(ccm.hsm_client_address, ccm.keyHSM_1, ccm.keyHSM_2, "CreateCk", k)
-	hexStr := fmt.Sprintf("%x", key)
-	// fmt.Println("Key Get from HSM : ", hexStr)
-	if len(key) == 0 {
-		return nil, fmt.Errorf("couldn't retrieve key for encryption")
+	// l'objet relu juste après son envoi n'aura pas à repasser par le HSM
+	if ccm.cache != nil {
+		ccm.cache.put(keyCacheId(key, ckContext), k)
 	}
-
-	k2 := *big.NewInt(1)
-	key2 := k2.Bytes()
+	// fmt.Println("Key Get from HSM : ", hex.EncodeToString(key))
 
 	// vecteur d'initialisation
 	iv, err := GenerateBytes(gcmNonceSize)
 	if err != nil {
-		return &materials.CryptographicMaterials{}, err
+		return nil, fmt.Errorf("%w: %w", ErrKeyGeneration, err)
 	}
-	newMatDesc := materials.MaterialDescription{
-		"ck": hexStr,
+	// la ck est la clé chiffrée de l'objet, la material description dit comment l'utiliser (cf format.go)
+	newMatDesc := materials.MaterialDescription{}
+	recordFormat(newMatDesc, WRAP_ALG_CK)
+	ccm.recordSlots(newMatDesc)
+	if bound {
+		newMatDesc[MATDESC_CONTEXT_KEY] = string(objectContext)
+	}
+	if !bytes.Equal(ckContext, objectContext) {
+		newMatDesc[MATDESC_CK_CONTEXT_KEY] = string(ckContext)
 	}
 
 	// on crée un cryptographicMaterials avec les infos pour le chiffrement
 	cryptoMaterials := &materials.CryptographicMaterials{
-		Key:          k, // on lui passe la clé récupérée auprès du client HSM
-		IV:           iv,
-		CEKAlgorithm: defaultAlgorithm,
-		TagLength:    GcmTagSizeBits,
-		EncryptedKey: key2,
+		Key:              k, // on lui passe la clé récupérée auprès du client HSM
+		IV:               iv,
+		KeyringAlgorithm: WRAP_ALG_CK,
+		CEKAlgorithm:     defaultAlgorithm,
+		TagLength:        GcmTagSizeBits,
+		EncryptedKey:     key,
 
 		MaterialDescription: newMatDesc,
 	}
@@ -111,36 +207,56 @@ func (ccm *CustomCryptographicMaterialsManager) DecryptMaterials(ctx context.Con
 	md := materials.MaterialDescription{}
 	err := md.DecodeDescription([]byte(req.MatDesc))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode material description: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrMalformedMatDesc, err)
 	}
-	ck, ok := md["ck"]
-	if !ok {
-		return nil, fmt.Errorf("ck not find.")
+	// le mode est donné par la material description, quel que soit celui du CMM
+	wrapAlg, err := formatOf(md)
+	if err != nil {
+		return nil, err
 	}
-
-	// fmt.Println("ck values : ", ck)
-	// TODO
-	ckbytes, err := hex.DecodeString(ck)
+	err = checkRequestAlgorithms(md, wrapAlg, req)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if wrapAlg == WRAP_ALG_TPRF {
+		return ccm.decryptMaterialsTPRF(ctx, md, req)
+	}
+	ckbytes, err := ckOf(md, req.CipherKey)
+	if err != nil {
+		return nil, err
 	}
 
-	key := hsmClient.GetKey(ccm.hsm_client_address, ccm.keyHSM_1, ccm.keyHSM_2, "GetKFromCK", ckbytes)
+	// si la ck a été liée à un objet, on vérifie que c'est bien celui qu'on déchiffre,
+	// et le HSM vérifie que le contexte n'a pas été modifié dans la material description
+	objectContext, _, err := checkObjectContext(ctx, md)
+	if err != nil {
+		return nil, err
+	}
+	// une ck partagée par plusieurs objets est liée à leur bucket (cf reuse.go)
+	ckContext, err := ckContextOf(md, objectContext)
+	if err != nil {
+		return nil, err
+	}
+	// la ck est déchiffrée par les emplacements qui l'ont créée (ils peuvent avoir changé depuis)
+	replicas, err := ccm.replicasOf(md)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ccm.cachedUnwrapKey(ctx, replicas, ckbytes, ckContext)
 	// hexStr := fmt.Sprintf("%x", key)
 	// fmt.Println("Key Get from HSM : ", hexStr)
 
-	if len(key) == 0 {
-		return nil, fmt.Errorf("couldn't retrieve key for decryption")
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't retrieve key for decryption: %w", ErrKeyRequest, err)
 	}
-	k2 := *big.NewInt(1)
-	key2 := k2.Bytes()
 	// on crée un cryptographicMaterials avec les infos pour le déchiffrement
 	cryptoMaterials := &materials.CryptographicMaterials{
-		Key:          key,
-		IV:           req.Iv,
-		CEKAlgorithm: defaultAlgorithm,
-		TagLength:    GcmTagSizeBits,
-		EncryptedKey: key2,
+		Key:              key,
+		IV:               req.Iv,
+		KeyringAlgorithm: wrapAlg,
+		CEKAlgorithm:     req.CekAlg,
+		TagLength:        GcmTagSizeBits,
+		EncryptedKey:     req.CipherKey,
 	}
 	// on renvoie le cryptographic Material
 	return cryptoMaterials, nil
@@ -0,0 +1,156 @@
+package awsEncryptionMaterials
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"awsClient/pkg/mockHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+func TestRoundTripWithoutContextBinding(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil)
+
+	cm, err := roundTrip(t, ccm, objectCtx("bucket", "key"), objectCtx("bucket", "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, bound := cm.MaterialDescription[MATDESC_CONTEXT_KEY]; bound {
+		t.Fatalf("object bound without WithContextBinding: %v", cm.MaterialDescription)
+	}
+	// un objet sans contexte se lit sous un autre nom
+	if _, err := roundTrip(t, ccm, context.Background(), objectCtx("bucket", "other")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTripWithContextBinding(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil, WithContextBinding())
+
+	cm, err := roundTrip(t, ccm, objectCtx("bucket", "dossier/été.txt"), objectCtx("bucket", "dossier/été.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.MaterialDescription[MATDESC_CONTEXT_KEY] != "bucket/dossier/été.txt" {
+		t.Fatalf("object not recorded in the material description: %v", cm.MaterialDescription)
+	}
+
+	// l'objet copié sous une autre clé ne se déchiffre pas
+	_, err = ccm.DecryptMaterials(objectCtx("bucket", "other"), decryptRequest(t, cm))
+	if !errors.Is(err, ErrContextMismatch) {
+		t.Fatalf("got %v, want ErrContextMismatch", err)
+	}
+	_, err = ccm.DecryptMaterials(context.Background(), decryptRequest(t, cm))
+	if !errors.Is(err, ErrContextMismatch) {
+		t.Fatalf("got %v without object, want ErrContextMismatch", err)
+	}
+	// un contexte modifié dans la material description est refusé par le HSM
+	cm.MaterialDescription[MATDESC_CONTEXT_KEY] = "bucket/other"
+	_, err = ccm.DecryptMaterials(objectCtx("bucket", "other"), decryptRequest(t, cm))
+	if !errors.Is(err, ErrKeyRequest) {
+		t.Fatalf("got %v, want ErrKeyRequest", err)
+	}
+
+	// un CMM sans liaison lit toujours les objets liés
+	cm.MaterialDescription[MATDESC_CONTEXT_KEY] = "bucket/dossier/été.txt"
+	unbound := newTestCMM(t, addr, nil)
+	if _, err := unbound.DecryptMaterials(objectCtx("bucket", "dossier/été.txt"), decryptRequest(t, cm)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptMaterialsHSMErrors(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil)
+	cm, err := ccm.GetEncryptionMaterials(context.Background(), materials.MaterialDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hsm := range []byte{17, 22} {
+		server.SetFault(hsm, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_ERROR, Status: 4})
+	}
+	_, err = ccm.DecryptMaterials(context.Background(), decryptRequest(t, cm))
+	if !errors.Is(err, ErrKeyRequest) || !errors.Is(err, ErrHSMUnavailable) {
+		t.Fatalf("got %v, want ErrKeyRequest wrapping ErrHSMUnavailable", err)
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	tests := []struct {
+		md      materials.MaterialDescription
+		wrapAlg string
+		err     error
+	}{
+		{materials.MaterialDescription{"ck": "00"}, WRAP_ALG_CK, nil},
+		{materials.MaterialDescription{MATDESC_TPRF_KEY: "00"}, WRAP_ALG_TPRF, nil},
+		{materials.MaterialDescription{MATDESC_FORMAT_KEY: FORMAT_VERSION, MATDESC_WRAP_ALG_KEY: WRAP_ALG_CK, MATDESC_CEK_ALG_KEY: defaultAlgorithm}, WRAP_ALG_CK, nil},
+		{materials.MaterialDescription{MATDESC_FORMAT_KEY: FORMAT_VERSION, MATDESC_WRAP_ALG_KEY: WRAP_ALG_TPRF, MATDESC_CEK_ALG_KEY: defaultAlgorithm}, WRAP_ALG_TPRF, nil},
+		{materials.MaterialDescription{MATDESC_FORMAT_KEY: FORMAT_VERSION, MATDESC_WRAP_ALG_KEY: "kms", MATDESC_CEK_ALG_KEY: defaultAlgorithm}, "", ErrUnsupportedAlgorithm},
+		{materials.MaterialDescription{MATDESC_FORMAT_KEY: FORMAT_VERSION, MATDESC_WRAP_ALG_KEY: WRAP_ALG_CK, MATDESC_CEK_ALG_KEY: AESCBCPKCS5Padding}, "", ErrUnsupportedAlgorithm},
+		{materials.MaterialDescription{MATDESC_FORMAT_KEY: "3"}, "", ErrUnsupportedFormat},
+	}
+	for _, test := range tests {
+		wrapAlg, err := formatOf(test.md)
+		if wrapAlg != test.wrapAlg || !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("formatOf(%v) = %q, %v, want %q, %v", test.md, wrapAlg, err, test.wrapAlg, test.err)
+		}
+	}
+}
+
+func TestCkOf(t *testing.T) {
+	ck := make([]byte, CK_SIZE)
+	format2 := materials.MaterialDescription{MATDESC_FORMAT_KEY: FORMAT_VERSION}
+	tests := []struct {
+		md        materials.MaterialDescription
+		cipherKey []byte
+		err       error
+	}{
+		{format2, ck, nil},
+		{materials.MaterialDescription{"ck": hex.EncodeToString(ck)}, nil, nil},
+		{format2, nil, ErrMissingCK},
+		{materials.MaterialDescription{}, nil, ErrMissingCK},
+		{materials.MaterialDescription{"ck": "not hex"}, nil, ErrMalformedCK},
+		{materials.MaterialDescription{"ck": "abcd"}, nil, ErrInvalidCKLength},
+		{format2, ck[:CK_SIZE-1], ErrInvalidCKLength},
+	}
+	for _, test := range tests {
+		_, err := ckOf(test.md, test.cipherKey)
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("ckOf(%v, %d bytes) = %v, want %v", test.md, len(test.cipherKey), err, test.err)
+		}
+	}
+}
+
+func TestDecryptMaterialsMalformed(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil)
+	cm, err := ccm.GetEncryptionMaterials(context.Background(), materials.MaterialDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := decryptRequest(t, cm)
+	req.MatDesc = "{not json"
+	if _, err := ccm.DecryptMaterials(context.Background(), req); !errors.Is(err, ErrMalformedMatDesc) {
+		t.Errorf("got %v, want ErrMalformedMatDesc", err)
+	}
+	req = decryptRequest(t, cm)
+	req.CipherKey = nil
+	if _, err := ccm.DecryptMaterials(context.Background(), req); !errors.Is(err, ErrMissingCK) {
+		t.Errorf("got %v, want ErrMissingCK", err)
+	}
+	req = decryptRequest(t, cm)
+	req.KeyringAlg = WRAP_ALG_TPRF
+	if _, err := ccm.DecryptMaterials(context.Background(), req); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("got %v, want ErrUnsupportedAlgorithm", err)
+	}
+	cm.MaterialDescription[MATDESC_SLOTS_KEY] = "17"
+	if _, err := ccm.DecryptMaterials(context.Background(), decryptRequest(t, cm)); !errors.Is(err, ErrMalformedMatDesc) {
+		t.Errorf("got %v, want ErrMalformedMatDesc", err)
+	}
+}
@@ -0,0 +1,160 @@
+package awsEncryptionMaterials
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	hsmClient "awsClient/pkg/requestHSMclient"
+)
+
+/*
+	Cache des clés de données.
+	Sans cache, chaque DecryptMaterials fait déchiffrer la ck par le HSM, même quand le même objet
+	est lu plusieurs fois (téléchargement par morceaux, lectures répétées).
+	Avec WithKeyCache, la clé de données est gardée en mémoire, indexée par la ck et l'objet
+	auquel elle est liée. Une clé est retirée du cache (et effacée) :
+	- quand sa durée de vie (TTL) est dépassée,
+	- quand elle a servi MaxUses fois,
+	- quand le cache est plein et qu'elle est la moins récemment utilisée (LRU).
+	Les objets en mode TPRF ne passent pas par le cache.
+*/
+
+// valeurs par défaut des options du cache
+const (
+	DEFAULT_KEY_CACHE_SIZE = 128
+	DEFAULT_KEY_CACHE_TTL  = 5 * time.Minute
+)
+
+type KeyCacheOptions struct {
+	Size    int           // nombre maximal de clés gardées (DEFAULT_KEY_CACHE_SIZE si 0)
+	TTL     time.Duration // durée de vie d'une clé dans le cache (DEFAULT_KEY_CACHE_TTL si 0)
+	MaxUses int           // nombre d'utilisations d'une clé avant qu'elle soit retirée (pas de limite si 0)
+}
+
+// option du CMM : garde en mémoire les clés de données déchiffrées par le HSM
+func WithKeyCache(options KeyCacheOptions) func(*CustomCryptographicMaterialsManager) {
+	return func(ccm *CustomCryptographicMaterialsManager) {
+		ccm.cache = newKeyCache(options)
+	}
+}
+
+// efface les clés gardées en mémoire par le cache et la clé réutilisée (cf reuse.go).
+// à appeler quand le CMM n'est plus utilisé
+func (ccm *CustomCryptographicMaterialsManager) ClearKeyCache() {
+	if ccm.cache != nil {
+		ccm.cache.clear()
+	}
+	if ccm.reuse != nil {
+		ccm.reuse.clear()
+	}
+}
+
+// comme unwrapKey, en passant d'abord par le cache s'il est activé
+func (ccm *CustomCryptographicMaterialsManager) cachedUnwrapKey(ctx context.Context, replicas []hsmClient.Replica, ck []byte, objectContext []byte) ([]byte, error) {
+	if ccm.cache == nil {
+		return ccm.unwrapKey(ctx, replicas, ck, objectContext)
+	}
+	id := keyCacheId(ck, objectContext)
+	if key, ok := ccm.cache.get(id); ok {
+		return key, nil
+	}
+	key, err := ccm.unwrapKey(ctx, replicas, ck, objectContext)
+	if err != nil {
+		return nil, err
+	}
+	ccm.cache.put(id, key)
+	return key, nil
+}
+
+type keyCacheEntry struct {
+	id      string
+	key     []byte
+	expires time.Time
+	uses    int
+}
+
+type keyCache struct {
+	options KeyCacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // de la plus récemment utilisée à la moins récemment utilisée
+}
+
+func newKeyCache(options KeyCacheOptions) *keyCache {
+	if options.Size <= 0 {
+		options.Size = DEFAULT_KEY_CACHE_SIZE
+	}
+	if options.TTL <= 0 {
+		options.TTL = DEFAULT_KEY_CACHE_TTL
+	}
+	return &keyCache{
+		options: options,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// identifiant d'une clé dans le cache : la ck (de taille fixe) suivie de l'objet auquel elle est liée.
+// le contexte en fait partie : une ck présentée avec un autre contexte doit être refusée par le HSM
+func keyCacheId(ck []byte, objectContext []byte) string {
+	return string(ck) + string(objectContext)
+}
+
+// renvoie une copie de la clé de données, et false si elle n'est pas (ou plus) dans le cache
+func (c *keyCache) get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*keyCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	entry.uses++
+	key := append([]byte(nil), entry.key...)
+	if c.options.MaxUses > 0 && entry.uses >= c.options.MaxUses {
+		c.remove(element)
+	} else {
+		c.lru.MoveToFront(element)
+	}
+	return key, true
+}
+
+// garde une copie de la clé de données, en retirant la moins récemment utilisée si le cache est plein
+func (c *keyCache) put(id string, key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[id]; ok {
+		c.remove(element)
+	}
+	for c.lru.Len() >= c.options.Size {
+		c.remove(c.lru.Back())
+	}
+	entry := &keyCacheEntry{
+		id:      id,
+		key:     append([]byte(nil), key...),
+		expires: time.Now().Add(c.options.TTL),
+	}
+	c.entries[id] = c.lru.PushFront(entry)
+}
+
+// retire une clé du cache et l'efface de la mémoire (appelée avec c.mu verrouillé)
+func (c *keyCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*keyCacheEntry)
+	delete(c.entries, entry.id)
+	clear(entry.key)
+}
+
+func (c *keyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
@@ -0,0 +1,103 @@
+package awsEncryptionMaterials
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"awsClient/pkg/mockHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+func TestKeyCacheLRU(t *testing.T) {
+	c := newKeyCache(KeyCacheOptions{Size: 2})
+	c.put("a", []byte("ka"))
+	c.put("b", []byte("kb"))
+	// a devient la plus récemment utilisée : b est évincée par c
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a not in the cache")
+	}
+	c.put("c", []byte("kc"))
+	if _, ok := c.get("b"); ok {
+		t.Fatal("b wasn't evicted")
+	}
+	for _, id := range []string{"a", "c"} {
+		if _, ok := c.get(id); !ok {
+			t.Fatalf("%s was evicted", id)
+		}
+	}
+}
+
+func TestKeyCacheTTL(t *testing.T) {
+	c := newKeyCache(KeyCacheOptions{TTL: 20 * time.Millisecond})
+	c.put("a", []byte("ka"))
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a not in the cache")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("a still in the cache after its TTL")
+	}
+}
+
+func TestKeyCacheMaxUses(t *testing.T) {
+	c := newKeyCache(KeyCacheOptions{MaxUses: 2})
+	key := []byte("ka")
+	c.put("a", key)
+	for range 2 {
+		if _, ok := c.get("a"); !ok {
+			t.Fatal("a removed before MaxUses")
+		}
+	}
+	if _, ok := c.get("a"); ok {
+		t.Fatal("a still in the cache after MaxUses")
+	}
+}
+
+// les clés sont copiées à l'entrée et à la sortie du cache, et effacées quand elles en sont retirées
+func TestKeyCacheCopiesAndClears(t *testing.T) {
+	c := newKeyCache(KeyCacheOptions{})
+	key := []byte("ka")
+	c.put("a", key)
+	key[0] = 'x'
+	got, _ := c.get("a")
+	if string(got) != "ka" {
+		t.Fatalf("got %q, the cache kept the caller's slice", got)
+	}
+	got[0] = 'y'
+	stored := c.entries["a"].Value.(*keyCacheEntry).key
+	if again, _ := c.get("a"); string(again) != "ka" {
+		t.Fatalf("got %q, the cache returned its own slice", again)
+	}
+	c.clear()
+	if c.lru.Len() != 0 || !bytes.Equal(stored, []byte{0, 0}) {
+		t.Fatalf("the cache wasn't cleared (%d keys, %q)", c.lru.Len(), stored)
+	}
+}
+
+// une clé en cache est donnée sans interroger le HSM, et seulement pour la même ck et le même objet
+func TestDecryptMaterialsCache(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil, WithContextBinding(), WithKeyCache(KeyCacheOptions{}))
+	cm, err := ccm.GetEncryptionMaterials(objectCtx("bucket", "key"), materials.MaterialDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hsm := range []byte{17, 22} {
+		server.SetFault(hsm, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_ERROR, Status: 4})
+	}
+	decrypted, err := ccm.DecryptMaterials(objectCtx("bucket", "key"), decryptRequest(t, cm))
+	if err != nil || !bytes.Equal(decrypted.Key, cm.Key) {
+		t.Fatalf("key not given by the cache: %v", err)
+	}
+
+	ccm.ClearKeyCache()
+	if _, err := ccm.DecryptMaterials(objectCtx("bucket", "key"), decryptRequest(t, cm)); err == nil {
+		t.Fatal("key given by the cache after ClearKeyCache")
+	}
+	if _, err := ccm.DecryptMaterials(context.Background(), decryptRequest(t, cm)); err == nil {
+		t.Fatal("key given for another object")
+	}
+}
@@ -0,0 +1,28 @@
+package awsEncryptionMaterials
+
+import (
+	"errors"
+
+	hsmClient "awsClient/pkg/requestHSMclient"
+)
+
+// erreurs renvoyées par le CMM, à tester avec errors.Is.
+// aucune erreur ne fait paniquer le CMM : l'appelant peut signaler l'objet en échec
+// et continuer avec les suivants (cf GetObject d'un dossier, rewrap)
+var (
+	ErrKeyGeneration        = errors.New("random generation failed")       // clé de données, vecteur d'initialisation ou nonce
+	ErrMalformedMatDesc     = errors.New("malformed material description") // material description illisible ou champ invalide
+	ErrMissingCK            = errors.New("missing ck")                     // ni clé chiffrée ni "ck" dans la material description
+	ErrMalformedCK          = errors.New("malformed ck")                   // "ck" n'est pas en hexadécimal
+	ErrInvalidCKLength      = errors.New("invalid ck length")              // la ck ne fait pas CK_SIZE octets
+	ErrKeyRequest           = errors.New("key request failed")             // le HSM n'a pas donné la clé, l'erreur du client HSM est aussi enveloppée
+	ErrContextMismatch      = errors.New("encryption context mismatch")    // objet copié ou déplacé vers une autre clé S3
+	ErrMissingContext       = errors.New("missing object context")         // objet (bucket/key) absent du contexte ou trop long, en mode TPRF
+	ErrRewrapUnsupported    = errors.New("rewrap unsupported")             // objet en mode TPRF : il faut rechiffrer le contenu
+	ErrUnsupportedFormat    = errors.New("unsupported material description format")
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+)
+
+// aucun keystore n'a pu être joint : errors.Is(err, ErrHSMUnavailable) distingue une panne
+// du HSM d'une erreur propre à l'objet
+var ErrHSMUnavailable = hsmClient.ErrHSMUnavailable
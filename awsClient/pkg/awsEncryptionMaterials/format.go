@@ -0,0 +1,98 @@
+package awsEncryptionMaterials
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+/*
+	Format de la material description.
+	Depuis le format 2, la material description décrit complètement comment l'objet a été chiffré :
+	- "format" : version du format (FORMAT_VERSION)
+	- "wrap_alg" : comment la clé de données est protégée, WRAP_ALG_CK (chiffrée en ck par le HSM)
+	  ou WRAP_ALG_TPRF (dérivée par les keystores, cf tprf.go)
+	- "cek_alg" : algorithme de chiffrement du contenu (AES/GCM/NoPadding)
+	La ck est rangée dans la clé chiffrée de l'objet (métadonnée x-amz-key-v2) et non plus dans
+	la material description. wrap_alg et cek_alg sont aussi dans les métadonnées x-amz-wrap-alg
+	et x-amz-cek-alg, DecryptMaterials vérifie qu'elles sont les mêmes.
+	Les objets sans "format" (format 1) gardent la ck en hexadécimal dans "ck" et sont toujours lisibles.
+	Un format ou un algorithme inconnu est refusé : mieux vaut une erreur claire que
+	déchiffrer avec le mauvais algorithme.
+*/
+
+const (
+	MATDESC_FORMAT_KEY   = "format"
+	MATDESC_WRAP_ALG_KEY = "wrap_alg"
+	MATDESC_CEK_ALG_KEY  = "cek_alg"
+	FORMAT_VERSION       = "2"
+	WRAP_ALG_CK          = "HSM/CK"
+	WRAP_ALG_TPRF        = "HSM/TPRF"
+)
+
+// enregistre le format et les algorithmes dans la material description
+func recordFormat(md materials.MaterialDescription, wrapAlg string) {
+	md[MATDESC_FORMAT_KEY] = FORMAT_VERSION
+	md[MATDESC_WRAP_ALG_KEY] = wrapAlg
+	md[MATDESC_CEK_ALG_KEY] = defaultAlgorithm
+}
+
+// vérifie le format et les algorithmes de la material description, et renvoie l'algorithme
+// de protection de la clé de données (déduit des champs présents pour le format 1)
+func formatOf(md materials.MaterialDescription) (string, error) {
+	switch md[MATDESC_FORMAT_KEY] {
+	case "":
+		if _, ok := md[MATDESC_TPRF_KEY]; ok {
+			return WRAP_ALG_TPRF, nil
+		}
+		return WRAP_ALG_CK, nil
+	case FORMAT_VERSION:
+		wrapAlg := md[MATDESC_WRAP_ALG_KEY]
+		if wrapAlg != WRAP_ALG_CK && wrapAlg != WRAP_ALG_TPRF {
+			return "", fmt.Errorf("%w: key wrapping algorithm %q", ErrUnsupportedAlgorithm, wrapAlg)
+		}
+		if cekAlg := md[MATDESC_CEK_ALG_KEY]; cekAlg != defaultAlgorithm {
+			return "", fmt.Errorf("%w: content encryption algorithm %q", ErrUnsupportedAlgorithm, cekAlg)
+		}
+		return wrapAlg, nil
+	}
+	return "", fmt.Errorf("%w: version %q (this client supports up to %s)", ErrUnsupportedFormat, md[MATDESC_FORMAT_KEY], FORMAT_VERSION)
+}
+
+// vérifie que les algorithmes des métadonnées de l'objet sont ceux de la material description
+func checkRequestAlgorithms(md materials.MaterialDescription, wrapAlg string, req materials.DecryptMaterialsRequest) error {
+	if req.CekAlg != defaultAlgorithm {
+		return fmt.Errorf("%w: content encryption algorithm %q", ErrUnsupportedAlgorithm, req.CekAlg)
+	}
+	if req.TagLength != "" && req.TagLength != GcmTagSizeBits {
+		return fmt.Errorf("%w: GCM tag of %s bits", ErrUnsupportedAlgorithm, req.TagLength)
+	}
+	if md[MATDESC_FORMAT_KEY] == FORMAT_VERSION && req.KeyringAlg != wrapAlg {
+		return fmt.Errorf("%w: key wrapping algorithm %q in the metadata, %q in the material description", ErrUnsupportedAlgorithm, req.KeyringAlg, wrapAlg)
+	}
+	return nil
+}
+
+// renvoie la ck de l'objet : sa clé chiffrée depuis le format 2, "ck" en hexadécimal avant
+func ckOf(md materials.MaterialDescription, cipherKey []byte) ([]byte, error) {
+	ck := cipherKey
+	if md[MATDESC_FORMAT_KEY] == "" {
+		hexCk, ok := md["ck"]
+		if !ok {
+			return nil, ErrMissingCK
+		}
+		var err error
+		ck, err = hex.DecodeString(hexCk)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformedCK, err)
+		}
+	}
+	if len(ck) == 0 {
+		return nil, ErrMissingCK
+	}
+	if len(ck) != CK_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes instead of %d", ErrInvalidCKLength, len(ck), CK_SIZE)
+	}
+	return ck, nil
+}
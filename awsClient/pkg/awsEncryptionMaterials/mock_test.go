@@ -0,0 +1,75 @@
+package awsEncryptionMaterials
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"awsClient/pkg/mockHSMclient"
+	hsmClient "awsClient/pkg/requestHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+// lance un faux client HSM sur un port libre de localhost, arrêté à la fin du test
+func startMock(t *testing.T, options mockHSMclient.Options) (*mockHSMclient.Server, string) {
+	t.Helper()
+	server := mockHSMclient.NewServer(options)
+	addr, err := server.Start()
+	if err != nil {
+		t.Fatalf("couldn't start the mock HSM client: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, addr
+}
+
+// crée un CMM qui utilise le faux client HSM à addr, avec la clé d'indice 1 des keystores 17 et 22
+// si d'autres répliques ne sont pas données
+func newTestCMM(t *testing.T, addr string, replicas []hsmClient.Replica, optFns ...func(*CustomCryptographicMaterialsManager)) *CustomCryptographicMaterialsManager {
+	t.Helper()
+	if replicas == nil {
+		replicas = hsmClient.Replicas(hsmClient.KeyHSM{Hsm_number: 17, Key_index: 1}, hsmClient.KeyHSM{Hsm_number: 22, Key_index: 1})
+	}
+	hsm := hsmClient.NewHSMClient(hsmClient.HSMClientOptions{MaxRetries: -1})
+	t.Cleanup(func() { hsm.Close() })
+	return NewCustomCryptographicMaterialsManager(addr, replicas, append([]func(*CustomCryptographicMaterialsManager){WithHSMClient(hsm)}, optFns...)...)
+}
+
+// contexte d'un put ou d'un get de l'objet
+func objectCtx(bucket, key string) context.Context {
+	return WithObjectContext(context.Background(), bucket, key)
+}
+
+// requête construite par le S3 encryption client à partir des métadonnées d'un objet chiffré avec cm
+func decryptRequest(t *testing.T, cm *materials.CryptographicMaterials) materials.DecryptMaterialsRequest {
+	t.Helper()
+	matDesc, err := cm.MaterialDescription.EncodeDescription()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return materials.DecryptMaterialsRequest{
+		CipherKey:  cm.EncryptedKey,
+		Iv:         cm.IV,
+		MatDesc:    string(matDesc),
+		KeyringAlg: cm.KeyringAlgorithm,
+		CekAlg:     cm.CEKAlgorithm,
+		TagLength:  cm.TagLength,
+	}
+}
+
+// chiffre un objet et vérifie que DecryptMaterials redonne sa clé de données
+func roundTrip(t *testing.T, ccm *CustomCryptographicMaterialsManager, putCtx, getCtx context.Context) (*materials.CryptographicMaterials, error) {
+	t.Helper()
+	cm, err := ccm.GetEncryptionMaterials(putCtx, materials.MaterialDescription{})
+	if err != nil {
+		t.Fatalf("GetEncryptionMaterials: %v", err)
+	}
+	decrypted, err := ccm.DecryptMaterials(getCtx, decryptRequest(t, cm))
+	if err != nil {
+		return cm, err
+	}
+	if !bytes.Equal(decrypted.Key, cm.Key) {
+		t.Fatalf("decrypted key %x, encrypted with %x", decrypted.Key, cm.Key)
+	}
+	return cm, nil
+}
@@ -0,0 +1,153 @@
+package awsEncryptionMaterials
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+/*
+	Réutilisation des clés de données.
+	Sans réutilisation, chaque GetEncryptionMaterials demande une nouvelle ck au HSM : l'envoi
+	d'un dossier de 50 000 fichiers fait 50 000 requêtes. Avec WithKeyReuse, une clé de données
+	chiffrée par le HSM sert à plusieurs objets, jusqu'à MaxObjects objets, MaxBytes octets
+	ou MaxAge de durée de vie : la charge du HSM dépend du temps et non du nombre de fichiers.
+	Chaque objet garde son propre vecteur d'initialisation.
+
+	Avec WithContextBinding, une ck partagée ne peut pas être liée à chaque objet : elle est liée au bucket par le HSM,
+	enregistré dans la material description sous "ck_ctx". L'objet reste dans "ctx" et est vérifié
+	au déchiffrement comme avant, et le HSM vérifie que "ck_ctx" est bien le bucket de la ck.
+	Quand Rewrap rechiffre une ck partagée, la nouvelle ck est liée à son objet (cf rotation.go).
+	La réutilisation ne s'applique pas au mode TPRF, où la clé est dérivée de l'objet.
+*/
+
+// clé de la material description où est gardé le contexte lié à une ck partagée
+const MATDESC_CK_CONTEXT_KEY = "ck_ctx"
+
+// valeurs par défaut des options de réutilisation
+const (
+	DEFAULT_KEY_REUSE_MAX_AGE = 5 * time.Minute
+	// au-delà, le risque de collision des vecteurs d'initialisation aléatoires de GCM n'est plus négligeable
+	MAX_KEY_REUSE_OBJECTS = math.MaxInt32
+)
+
+type KeyReuseOptions struct {
+	MaxObjects int           // nombre d'objets chiffrés avec une même clé (MAX_KEY_REUSE_OBJECTS si 0)
+	MaxBytes   int64         // nombre d'octets chiffrés avec une même clé (pas de limite si 0)
+	MaxAge     time.Duration // durée d'utilisation d'une clé (DEFAULT_KEY_REUSE_MAX_AGE si 0)
+}
+
+// option du CMM : une clé de données chiffrée par le HSM sert à plusieurs objets
+func WithKeyReuse(options KeyReuseOptions) func(*CustomCryptographicMaterialsManager) {
+	return func(ccm *CustomCryptographicMaterialsManager) {
+		if options.MaxObjects <= 0 || options.MaxObjects > MAX_KEY_REUSE_OBJECTS {
+			options.MaxObjects = MAX_KEY_REUSE_OBJECTS
+		}
+		if options.MaxAge <= 0 {
+			options.MaxAge = DEFAULT_KEY_REUSE_MAX_AGE
+		}
+		ccm.reuse = &keyReuse{options: options}
+	}
+}
+
+// clé du contexte sous laquelle PutObject range la taille de l'objet
+const OBJECT_SIZE_KEY = FavContextKey("size")
+
+// ajoute au contexte la taille de l'objet à chiffrer, comptée dans la limite MaxBytes
+func WithObjectSize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, OBJECT_SIZE_KEY, size)
+}
+
+// récupère la taille rangée dans le contexte par WithObjectSize
+func ObjectSize(ctx context.Context) (int64, bool) {
+	size, ok := ctx.Value(OBJECT_SIZE_KEY).(int64)
+	return size, ok
+}
+
+// bucket de l'objet "bucket/key" (un nom de bucket ne contient pas de "/")
+func bucketOf(objectContext []byte) []byte {
+	bucket, _, _ := bytes.Cut(objectContext, []byte("/"))
+	return bucket
+}
+
+// clé de données en cours de réutilisation, et sa ck
+type keyReuse struct {
+	options KeyReuseOptions
+
+	mu      sync.Mutex
+	k       []byte
+	ck      []byte
+	context []byte // contexte lié à la ck : le bucket
+	created time.Time
+	objects int
+	bytes   int64
+}
+
+// renvoie la clé de données, sa ck et le contexte lié à la ck pour chiffrer l'objet.
+// la clé en cours est réutilisée si elle a été créée pour le même bucket et que l'objet
+// ne dépasse aucune limite, sinon une nouvelle clé est chiffrée par le HSM.
+// un objet de taille inconnue avec une limite MaxBytes a sa propre clé.
+func (ccm *CustomCryptographicMaterialsManager) reusedKey(ctx context.Context, objectContext []byte) ([]byte, []byte, []byte, error) {
+	r := ccm.reuse
+	size, known := ObjectSize(ctx)
+	if r.options.MaxBytes > 0 && !known {
+		return ccm.newDataKey(ctx, objectContext)
+	}
+	ckContext := bucketOf(objectContext)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.k == nil || !bytes.Equal(r.context, ckContext) || r.objects >= r.options.MaxObjects ||
+		(r.options.MaxBytes > 0 && r.bytes+size > r.options.MaxBytes) || time.Since(r.created) >= r.options.MaxAge {
+		k, ck, _, err := ccm.newDataKey(ctx, ckContext)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// l'ancienne clé n'est plus utilisée pour chiffrer : elle est effacée
+		clear(r.k)
+		r.k, r.ck, r.context = k, ck, ckContext
+		r.created, r.objects, r.bytes = time.Now(), 0, 0
+	}
+	r.objects++
+	r.bytes += size
+	return append([]byte(nil), r.k...), r.ck, r.context, nil
+}
+
+// efface la clé en cours : le prochain objet aura une nouvelle clé
+func (r *keyReuse) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.k)
+	r.k, r.ck, r.context = nil, nil, nil
+}
+
+// tire une clé de données et la fait chiffrer en ck par le HSM, liée au contexte donné
+func (ccm *CustomCryptographicMaterialsManager) newDataKey(ctx context.Context, ckContext []byte) ([]byte, []byte, []byte, error) {
+	k, err := GenerateBytes(32)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %w", ErrKeyGeneration, err)
+	}
+	ck, err := ccm.wrapKey(ctx, k, ckContext)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: couldn't retrieve key for encryption: %w", ErrKeyRequest, err)
+	}
+	return k, ck, ckContext, nil
+}
+
+// renvoie le contexte lié à la ck : "ck_ctx" pour une ck partagée, qui doit être le bucket
+// de l'objet, et l'objet lui-même sinon
+func ckContextOf(md materials.MaterialDescription, objectContext []byte) ([]byte, error) {
+	ckContext, shared := md[MATDESC_CK_CONTEXT_KEY]
+	if !shared {
+		return objectContext, nil
+	}
+	if len(objectContext) == 0 || !bytes.Equal([]byte(ckContext), bucketOf(objectContext)) {
+		return nil, fmt.Errorf("%w: key shared in %q, object %q", ErrContextMismatch, ckContext, objectContext)
+	}
+	return []byte(ckContext), nil
+}
@@ -0,0 +1,124 @@
+package awsEncryptionMaterials
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"awsClient/pkg/mockHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+// chiffre un objet de la taille donnée (inconnue si elle est négative)
+func putWithSize(t *testing.T, ccm *CustomCryptographicMaterialsManager, bucket, key string, size int64) *materials.CryptographicMaterials {
+	t.Helper()
+	ctx := objectCtx(bucket, key)
+	if size >= 0 {
+		ctx = WithObjectSize(ctx, size)
+	}
+	cm, err := ccm.GetEncryptionMaterials(ctx, materials.MaterialDescription{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+func TestKeyReuseMaxObjects(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil, WithContextBinding(), WithKeyReuse(KeyReuseOptions{MaxObjects: 2}))
+	first := putWithSize(t, ccm, "bucket", "a", 10)
+	second := putWithSize(t, ccm, "bucket", "b", 10)
+	third := putWithSize(t, ccm, "bucket", "c", 10)
+	if !bytes.Equal(first.EncryptedKey, second.EncryptedKey) || !bytes.Equal(first.Key, second.Key) {
+		t.Fatal("the key wasn't reused")
+	}
+	if bytes.Equal(second.EncryptedKey, third.EncryptedKey) {
+		t.Fatal("the key was used for more than MaxObjects objects")
+	}
+	if bytes.Equal(first.IV, second.IV) {
+		t.Fatal("two objects have the same IV")
+	}
+	// la ck partagée est liée au bucket, l'objet est toujours vérifié
+	if first.MaterialDescription[MATDESC_CK_CONTEXT_KEY] != "bucket" || second.MaterialDescription[MATDESC_CONTEXT_KEY] != "bucket/b" {
+		t.Fatalf("unexpected material description %v", second.MaterialDescription)
+	}
+	decrypted, err := ccm.DecryptMaterials(objectCtx("bucket", "b"), decryptRequest(t, second))
+	if err != nil || !bytes.Equal(decrypted.Key, second.Key) {
+		t.Fatalf("couldn't decrypt an object with a shared key: %v", err)
+	}
+	if _, err := ccm.DecryptMaterials(objectCtx("bucket", "a"), decryptRequest(t, second)); !errors.Is(err, ErrContextMismatch) {
+		t.Fatalf("got %v, want ErrContextMismatch", err)
+	}
+	// "ck_ctx" changé pour un autre bucket est refusé
+	second.MaterialDescription[MATDESC_CK_CONTEXT_KEY] = "other"
+	if _, err := ccm.DecryptMaterials(objectCtx("bucket", "b"), decryptRequest(t, second)); !errors.Is(err, ErrContextMismatch) {
+		t.Fatalf("got %v, want ErrContextMismatch", err)
+	}
+}
+
+func TestKeyReuseMaxBytes(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil, WithContextBinding(), WithKeyReuse(KeyReuseOptions{MaxBytes: 100}))
+	first := putWithSize(t, ccm, "bucket", "a", 60)
+	second := putWithSize(t, ccm, "bucket", "b", 40)
+	third := putWithSize(t, ccm, "bucket", "c", 1)
+	if !bytes.Equal(first.EncryptedKey, second.EncryptedKey) {
+		t.Fatal("the key wasn't reused within MaxBytes")
+	}
+	if bytes.Equal(second.EncryptedKey, third.EncryptedKey) {
+		t.Fatal("the key was used for more than MaxBytes bytes")
+	}
+	// un objet de taille inconnue a sa propre clé
+	unknown := putWithSize(t, ccm, "bucket", "d", -1)
+	if bytes.Equal(third.EncryptedKey, unknown.EncryptedKey) {
+		t.Fatal("an object of unknown size reused the key")
+	}
+	if _, shared := unknown.MaterialDescription[MATDESC_CK_CONTEXT_KEY]; shared {
+		t.Fatal("the key of an object of unknown size is bound to the bucket")
+	}
+}
+
+func TestKeyReuseMaxAgeAndBucket(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil, WithContextBinding(), WithKeyReuse(KeyReuseOptions{MaxAge: 30 * time.Millisecond}))
+	first := putWithSize(t, ccm, "bucket", "a", 1)
+	other := putWithSize(t, ccm, "other", "a", 1)
+	if bytes.Equal(first.EncryptedKey, other.EncryptedKey) {
+		t.Fatal("the key was reused for another bucket")
+	}
+	again := putWithSize(t, ccm, "other", "b", 1)
+	time.Sleep(40 * time.Millisecond)
+	late := putWithSize(t, ccm, "other", "c", 1)
+	if !bytes.Equal(other.EncryptedKey, again.EncryptedKey) || bytes.Equal(again.EncryptedKey, late.EncryptedKey) {
+		t.Fatal("the key wasn't renewed after MaxAge")
+	}
+
+	// ClearKeyCache efface la clé réutilisée
+	ccm.ClearKeyCache()
+	cleared := putWithSize(t, ccm, "other", "d", 1)
+	if bytes.Equal(late.EncryptedKey, cleared.EncryptedKey) {
+		t.Fatal("the key was reused after ClearKeyCache")
+	}
+}
+
+// sans liaison au contexte, la ck partagée n'est liée à rien
+func TestKeyReuseWithoutContextBinding(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, nil, WithKeyReuse(KeyReuseOptions{MaxObjects: 2}))
+	first := putWithSize(t, ccm, "bucket", "a", 1)
+	second := putWithSize(t, ccm, "bucket", "b", 1)
+	if !bytes.Equal(first.EncryptedKey, second.EncryptedKey) {
+		t.Fatal("the key wasn't reused")
+	}
+	for _, key := range []string{MATDESC_CONTEXT_KEY, MATDESC_CK_CONTEXT_KEY} {
+		if _, bound := second.MaterialDescription[key]; bound {
+			t.Fatalf("unexpected material description %v", second.MaterialDescription)
+		}
+	}
+	if _, err := ccm.DecryptMaterials(context.Background(), decryptRequest(t, second)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,177 @@
+package awsEncryptionMaterials
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	hsmClient "awsClient/pkg/requestHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+/*
+	Rotation des clés du HSM.
+	La material description de chaque objet garde les emplacements (keystore:index) qui ont
+	créé sa ck, et la version de la clé :
+	- "slots" : "17:1,22:1"
+	- "key_version" : "1"
+	Au déchiffrement, la ck est envoyée à ces emplacements, et non à ceux de la configuration :
+	après une rotation (nouvel index dans -keys), les anciens objets restent lisibles tant que
+	l'ancienne clé est sur le HSM. Rewrap déchiffre la ck avec l'ancienne clé
+	et la rechiffre avec la nouvelle, sans toucher au contenu de l'objet (cf awsClient/rewrap.go).
+	Les objets sans "slots" (chiffrés avant) sont déchiffrés avec les emplacements de la configuration.
+*/
+
+// clés de la material description pour la rotation
+const (
+	MATDESC_SLOTS_KEY   = "slots"
+	MATDESC_VERSION_KEY = "key_version"
+)
+
+// version de la clé quand aucune n'est donnée (cf WithKeyVersion)
+const DEFAULT_KEY_VERSION = 1
+
+// option du CMM : version de la clé des répliques, enregistrée dans la material description.
+// elle est à augmenter à chaque rotation, pour que rewrap sache quels objets sont à jour
+func WithKeyVersion(version int) func(*CustomCryptographicMaterialsManager) {
+	return func(ccm *CustomCryptographicMaterialsManager) {
+		ccm.key_version = version
+	}
+}
+
+// emplacements des répliques, au format de la material description
+func slotsOf(replicas []hsmClient.Replica) string {
+	slots := make([]string, 0, len(replicas))
+	for _, replica := range replicas {
+		slots = append(slots, replica.KeyHSM.String())
+	}
+	return strings.Join(slots, ",")
+}
+
+// enregistre les emplacements et la version de la clé dans la material description
+func (ccm *CustomCryptographicMaterialsManager) recordSlots(md materials.MaterialDescription) {
+	md[MATDESC_SLOTS_KEY] = slotsOf(ccm.replicas)
+	md[MATDESC_VERSION_KEY] = strconv.Itoa(ccm.key_version)
+}
+
+// renvoie les répliques qui ont créé la ck de la material description.
+// une réplique d'un keystore de la configuration en garde la priorité, le poids et les adresses.
+func (ccm *CustomCryptographicMaterialsManager) replicasOf(md materials.MaterialDescription) ([]hsmClient.Replica, error) {
+	slots, ok := md[MATDESC_SLOTS_KEY]
+	if !ok {
+		return ccm.replicas, nil
+	}
+	replicas := []hsmClient.Replica{}
+	for _, slot := range strings.Split(slots, ",") {
+		hsm, index, found := strings.Cut(slot, ":")
+		hsm_number, err1 := strconv.Atoi(hsm)
+		key_index, err2 := strconv.Atoi(index)
+		if !found || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%w: invalid key slot %q", ErrMalformedMatDesc, slot)
+		}
+		replica := hsmClient.Replica{KeyHSM: hsmClient.KeyHSM{Hsm_number: hsm_number, Key_index: key_index}}
+		for _, configured := range ccm.replicas {
+			if configured.Hsm_number == hsm_number {
+				replica.Priority, replica.Weight, replica.Addresses = configured.Priority, configured.Weight, configured.Addresses
+			}
+		}
+		if err := replica.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMalformedMatDesc, err)
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas, nil
+}
+
+// fait chiffrer la clé de données en ck par les répliques de la configuration,
+// liée à l'objet s'il est donné
+func (ccm *CustomCryptographicMaterialsManager) wrapKey(ctx context.Context, k []byte, objectContext []byte) ([]byte, error) {
+	action, payload := "CreateCk", k
+	if len(objectContext) > 0 {
+		var err error
+		action = "CreateCkCtx"
+		payload, err = hsmClient.ContextPayload(k, objectContext)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't bind the encryption context: %w", err)
+		}
+	}
+	return ccm.hsm.GetKey(ctx, ccm.hsm_client_address, ccm.replicas, action, payload)
+}
+
+// fait déchiffrer la ck par les répliques données, avec l'objet auquel elle est liée s'il est donné
+func (ccm *CustomCryptographicMaterialsManager) unwrapKey(ctx context.Context, replicas []hsmClient.Replica, ck []byte, objectContext []byte) ([]byte, error) {
+	action, payload := "GetKFromCK", ck
+	if len(objectContext) > 0 {
+		var err error
+		action = "GetKFromCKCtx"
+		payload, err = hsmClient.ContextPayload(ck, objectContext)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't bind the encryption context: %w", err)
+		}
+	}
+	return ccm.hsm.GetKey(ctx, ccm.hsm_client_address, replicas, action, payload)
+}
+
+// clé chiffrée d'un objet, telle que dans ses métadonnées : la material description encodée
+// et la clé chiffrée (la ck depuis le format 2, vide avant)
+type WrappedKey struct {
+	MatDesc   string
+	CipherKey []byte
+}
+
+// rechiffre la ck de l'objet avec les répliques et la version de clé du CMM.
+// un objet au format 1 passe au format courant (cf format.go).
+// renvoie la nouvelle clé chiffrée, et false si elle était déjà à jour.
+func (ccm *CustomCryptographicMaterialsManager) Rewrap(ctx context.Context, wrapped WrappedKey) (WrappedKey, bool, error) {
+	md := materials.MaterialDescription{}
+	err := md.DecodeDescription([]byte(wrapped.MatDesc))
+	if err != nil {
+		return wrapped, false, fmt.Errorf("%w: %w", ErrMalformedMatDesc, err)
+	}
+	wrapAlg, err := formatOf(md)
+	if err != nil {
+		return wrapped, false, err
+	}
+	if wrapAlg == WRAP_ALG_TPRF {
+		return wrapped, false, fmt.Errorf("%w: the key of an object encrypted in TPRF mode is derived from the keystores", ErrRewrapUnsupported)
+	}
+	if md[MATDESC_FORMAT_KEY] == FORMAT_VERSION && md[MATDESC_SLOTS_KEY] == slotsOf(ccm.replicas) && md[MATDESC_VERSION_KEY] == strconv.Itoa(ccm.key_version) {
+		return wrapped, false, nil
+	}
+	ckbytes, err := ckOf(md, wrapped.CipherKey)
+	if err != nil {
+		return wrapped, false, err
+	}
+
+	// le HSM vérifie que le contexte de la material description est celui de la ck.
+	// une ck partagée par plusieurs objets (cf reuse.go) est de nouveau liée à son objet
+	objectContext := []byte(md[MATDESC_CONTEXT_KEY])
+	ckContext, err := ckContextOf(md, objectContext)
+	if err != nil {
+		return wrapped, false, err
+	}
+	replicas, err := ccm.replicasOf(md)
+	if err != nil {
+		return wrapped, false, err
+	}
+	k, err := ccm.unwrapKey(ctx, replicas, ckbytes, ckContext)
+	if err != nil {
+		return wrapped, false, fmt.Errorf("%w: couldn't unwrap the ck with the key at %s: %w", ErrKeyRequest, slotsOf(replicas), err)
+	}
+	newCk, err := ccm.wrapKey(ctx, k, objectContext)
+	if err != nil {
+		return wrapped, false, fmt.Errorf("%w: couldn't wrap the key with the key at %s: %w", ErrKeyRequest, slotsOf(ccm.replicas), err)
+	}
+	clear(k)
+	delete(md, "ck")
+	delete(md, MATDESC_CK_CONTEXT_KEY)
+	recordFormat(md, WRAP_ALG_CK)
+	ccm.recordSlots(md)
+	encoded, err := md.EncodeDescription()
+	if err != nil {
+		return wrapped, false, err
+	}
+	return WrappedKey{MatDesc: string(encoded), CipherKey: newCk}, true, nil
+}
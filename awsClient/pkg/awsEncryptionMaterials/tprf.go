@@ -0,0 +1,136 @@
+package awsEncryptionMaterials
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	hsmClient "awsClient/pkg/requestHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+/*
+	Mode TPRF du CMM : au lieu de tirer une clé de données au hasard et de la faire chiffrer
+	par le HSM (ck), la clé est dérivée d'une PRF à seuil évaluée par t keystores parmi
+	les répliques (cf requestHSMclient/tprf.go). Aucun keystore ne connaît la clé de la PRF,
+	et la clé de données peut être retrouvée tant que t keystores répondent.
+	Au chiffrement, t+1 keystores sont interrogés : la clé n'est utilisée que si deux groupes
+	différents de t keystores donnent la même (sinon un keystore défaillant ou un seuil différent
+	de celui des keystores rendrait l'objet illisible). Il faut donc au moins t+1 répliques,
+	toutes au même index.
+
+	L'entrée de la PRF est l'objet (bucket/key, cf WithObjectContext) suivi d'un nonce aléatoire,
+	pour que chaque version de l'objet ait sa propre clé. La material description garde :
+	- "tprf" : le nonce (en hexadécimal)
+	- "t" : le seuil utilisé au chiffrement
+	- "ctx" : l'objet, vérifié au déchiffrement comme pour une ck liée à un contexte
+	- "slots" et "key_version" : les emplacements des parts de la clé (cf rotation.go)
+	- "format", "wrap_alg" (WRAP_ALG_TPRF) et "cek_alg" (cf format.go)
+*/
+
+// clés de la material description en mode TPRF
+const (
+	MATDESC_TPRF_KEY      = "tprf"
+	MATDESC_THRESHOLD_KEY = "t"
+)
+
+// taille du nonce ajouté à l'objet dans l'entrée de la PRF
+const tprfNonceSize = 16
+
+// option du CMM : les clés de données sont dérivées par une PRF à seuil,
+// évaluée par threshold keystores parmi les répliques
+func WithTPRF(threshold int) func(*CustomCryptographicMaterialsManager) {
+	return func(ccm *CustomCryptographicMaterialsManager) {
+		ccm.tprf_threshold = threshold
+	}
+}
+
+// entrée de la PRF : taille de l'objet (2 octets), objet, nonce
+func tprfInput(objectContext []byte, nonce []byte) []byte {
+	input := binary.BigEndian.AppendUint16(nil, uint16(len(objectContext)))
+	input = append(input, objectContext...)
+	return append(input, nonce...)
+}
+
+func (ccm *CustomCryptographicMaterialsManager) getEncryptionMaterialsTPRF(ctx context.Context) (*materials.CryptographicMaterials, error) {
+	// la clé est dérivée de l'objet : il doit être dans le contexte
+	objectContext, ok := ObjectContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("%w: the TPRF mode needs the object (bucket/key) in the context", ErrMissingContext)
+	}
+	if len(objectContext) > hsmClient.MAX_CONTEXT_SIZE {
+		return nil, fmt.Errorf("%w: object name of %d bytes is too long (max %d)", ErrMissingContext, len(objectContext), hsmClient.MAX_CONTEXT_SIZE)
+	}
+	nonce, err := GenerateBytes(tprfNonceSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrKeyGeneration, err)
+	}
+	// t+1 keystores sont interrogés, pour vérifier que la clé pourra être retrouvée par d'autres keystores
+	key, err := ccm.hsm.DeriveKeyTPRFVerified(ctx, ccm.hsm_client_address, ccm.replicas, ccm.tprf_threshold, tprfInput(objectContext, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't derive key for encryption: %w", ErrKeyRequest, err)
+	}
+
+	// vecteur d'initialisation
+	iv, err := GenerateBytes(gcmNonceSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrKeyGeneration, err)
+	}
+	// la clé n'est pas stockée : il n'y a pas de clé chiffrée
+	cryptoMaterials := &materials.CryptographicMaterials{
+		Key:              key,
+		IV:               iv,
+		KeyringAlgorithm: WRAP_ALG_TPRF,
+		CEKAlgorithm:     defaultAlgorithm,
+		TagLength:        GcmTagSizeBits,
+		EncryptedKey:     []byte{},
+
+		MaterialDescription: materials.MaterialDescription{
+			MATDESC_TPRF_KEY:      hex.EncodeToString(nonce),
+			MATDESC_THRESHOLD_KEY: strconv.Itoa(ccm.tprf_threshold),
+			MATDESC_CONTEXT_KEY:   string(objectContext),
+		},
+	}
+	recordFormat(cryptoMaterials.MaterialDescription, WRAP_ALG_TPRF)
+	ccm.recordSlots(cryptoMaterials.MaterialDescription)
+	return cryptoMaterials, nil
+}
+
+func (ccm *CustomCryptographicMaterialsManager) decryptMaterialsTPRF(ctx context.Context, md materials.MaterialDescription, req materials.DecryptMaterialsRequest) (*materials.CryptographicMaterials, error) {
+	objectContext, bound, err := checkObjectContext(ctx, md)
+	if err != nil {
+		return nil, err
+	}
+	if !bound {
+		return nil, fmt.Errorf("%w: object encrypted in TPRF mode without its name", ErrMalformedMatDesc)
+	}
+	nonce, err := hex.DecodeString(md[MATDESC_TPRF_KEY])
+	if err != nil || len(nonce) != tprfNonceSize {
+		return nil, fmt.Errorf("%w: invalid TPRF nonce", ErrMalformedMatDesc)
+	}
+	threshold, err := strconv.Atoi(md[MATDESC_THRESHOLD_KEY])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid TPRF threshold", ErrMalformedMatDesc)
+	}
+	replicas, err := ccm.replicasOf(md)
+	if err != nil {
+		return nil, err
+	}
+	// une erreur sur l'objet, le nonce ou le seuil donne une autre clé :
+	// le déchiffrement échoue alors sur le tag GCM
+	key, err := ccm.hsm.DeriveKeyTPRF(ctx, ccm.hsm_client_address, replicas, threshold, tprfInput(objectContext, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("%w: couldn't derive key for decryption: %w", ErrKeyRequest, err)
+	}
+	return &materials.CryptographicMaterials{
+		Key:              key,
+		IV:               req.Iv,
+		KeyringAlgorithm: WRAP_ALG_TPRF,
+		CEKAlgorithm:     req.CekAlg,
+		TagLength:        GcmTagSizeBits,
+		EncryptedKey:     req.CipherKey,
+	}, nil
+}
@@ -0,0 +1,66 @@
+package awsEncryptionMaterials
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"awsClient/pkg/mockHSMclient"
+	hsmClient "awsClient/pkg/requestHSMclient"
+
+	"github.com/aws/amazon-s3-encryption-client-go/v3/materials"
+)
+
+// keystores 1, 2 et 3, à l'indice 5
+var tprfReplicas = hsmClient.Replicas(hsmClient.KeyHSM{Hsm_number: 1, Key_index: 5}, hsmClient.KeyHSM{Hsm_number: 2, Key_index: 5}, hsmClient.KeyHSM{Hsm_number: 3, Key_index: 5})
+
+func TestTPRFRoundTrip(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{TPRFThreshold: 2})
+	ccm := newTestCMM(t, addr, tprfReplicas, WithTPRF(2))
+	cm, err := roundTrip(t, ccm, objectCtx("bucket", "key"), objectCtx("bucket", "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.KeyringAlgorithm != WRAP_ALG_TPRF || len(cm.EncryptedKey) != 0 || cm.MaterialDescription[MATDESC_THRESHOLD_KEY] != "2" {
+		t.Fatalf("unexpected materials %s %x %v", cm.KeyringAlgorithm, cm.EncryptedKey, cm.MaterialDescription)
+	}
+
+	// la clé est retrouvée par d'autres keystores
+	for _, down := range []byte{1, 2, 3} {
+		server.SetFault(down, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_ERROR, Status: 4})
+		decrypted, err := newTestCMM(t, addr, tprfReplicas, WithTPRF(2)).DecryptMaterials(objectCtx("bucket", "key"), decryptRequest(t, cm))
+		if err != nil || string(decrypted.Key) != string(cm.Key) {
+			t.Fatalf("with HSM %d down: %v", down, err)
+		}
+		server.SetFault(down, mockHSMclient.Fault{})
+	}
+
+	// l'objet copié sous une autre clé ne se déchiffre pas
+	if _, err := ccm.DecryptMaterials(objectCtx("bucket", "other"), decryptRequest(t, cm)); !errors.Is(err, ErrContextMismatch) {
+		t.Fatalf("got %v, want ErrContextMismatch", err)
+	}
+}
+
+func TestTPRFEncryptionChecksTheKey(t *testing.T) {
+	// seuil du CMM plus bas que celui des keystores : la clé ne pourrait pas être retrouvée
+	_, addr := startMock(t, mockHSMclient.Options{TPRFThreshold: 3})
+	ccm := newTestCMM(t, addr, tprfReplicas, WithTPRF(2))
+	_, err := ccm.GetEncryptionMaterials(objectCtx("bucket", "key"), materials.MaterialDescription{})
+	if !errors.Is(err, ErrKeyRequest) || !errors.Is(err, hsmClient.ErrKeyMismatch) {
+		t.Fatalf("got %v, want ErrKeyRequest wrapping ErrKeyMismatch", err)
+	}
+
+	// t répliques ne suffisent pas à vérifier la clé
+	ccm = newTestCMM(t, addr, tprfReplicas, WithTPRF(3))
+	if _, err := ccm.GetEncryptionMaterials(objectCtx("bucket", "key"), materials.MaterialDescription{}); !errors.Is(err, hsmClient.ErrBadRequest) {
+		t.Fatalf("got %v, want ErrBadRequest", err)
+	}
+}
+
+func TestTPRFMissingContext(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	ccm := newTestCMM(t, addr, tprfReplicas, WithTPRF(2))
+	if _, err := ccm.GetEncryptionMaterials(context.Background(), materials.MaterialDescription{}); !errors.Is(err, ErrMissingContext) {
+		t.Fatalf("got %v, want ErrMissingContext", err)
+	}
+}
@@ -0,0 +1,238 @@
+package mockHSMclient
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Fault injection, to test how the AWS client reacts when a keystore misbehaves.
+	A fault is set per keystore number with SetFault, or parsed with ParseFaultSpec :
+	  17=refuse                closes the connexion without answering
+	  17=hang                  never answers (the client has to time out)
+	  17=error:4               answers with the given status (4 : HSM unavailable)
+	  17=truncate              sends only half of the answer
+	  17=corrupt               flips the bits of the key in the answer (the status stays a success)
+	  17=latency:200ms         adds a fixed latency before answering
+	  17=latency:200ms:100ms   adds a fixed latency and a random jitter (< 100ms)
+	  17=none                  removes the fault
+	ControlHandler serves an HTTP endpoint to change them while the server is running :
+	  GET /faults                      lists the faults
+	  PUT /faults?hsm=17&fault=hang    sets the fault of keystore 17
+	  DELETE /faults?hsm=17            removes it (all the faults if hsm is omitted)
+	With the framed protocol, the requests to both keystores share the connexion :
+	"refuse" closes it for all of them.
+*/
+
+type FaultKind string
+
+const (
+	FAULT_NONE     FaultKind = "none"
+	FAULT_REFUSE   FaultKind = "refuse"
+	FAULT_HANG     FaultKind = "hang"
+	FAULT_ERROR    FaultKind = "error"
+	FAULT_TRUNCATE FaultKind = "truncate"
+	FAULT_CORRUPT  FaultKind = "corrupt"
+	FAULT_LATENCY  FaultKind = "latency"
+)
+
+type Fault struct {
+	Kind    FaultKind
+	Status  byte          // FAULT_ERROR : status returned
+	Latency time.Duration // FAULT_LATENCY : fixed latency added
+	Jitter  time.Duration // FAULT_LATENCY : maximum random latency added
+}
+
+func (f Fault) String() string {
+	switch f.Kind {
+	case FAULT_ERROR:
+		return fmt.Sprintf("%s:%d", f.Kind, f.Status)
+	case FAULT_LATENCY:
+		return fmt.Sprintf("%s:%s:%s", f.Kind, f.Latency, f.Jitter)
+	}
+	return string(f.Kind)
+}
+
+// parses a fault : "hang", "error:4", "latency:200ms:100ms"...
+func ParseFault(value string) (Fault, error) {
+	parts := strings.Split(value, ":")
+	f := Fault{Kind: FaultKind(parts[0])}
+	switch f.Kind {
+	case FAULT_NONE, FAULT_REFUSE, FAULT_HANG, FAULT_TRUNCATE, FAULT_CORRUPT:
+		if len(parts) != 1 {
+			return f, fmt.Errorf("fault %s takes no argument", f.Kind)
+		}
+	case FAULT_ERROR:
+		if len(parts) != 2 {
+			return f, fmt.Errorf("expected error:<status>")
+		}
+		status, err := strconv.ParseUint(parts[1], 10, 8)
+		if err != nil || status == uint64(GET_KEY_SUCCESS_CODE) {
+			return f, fmt.Errorf("invalid error status %q", parts[1])
+		}
+		f.Status = byte(status)
+	case FAULT_LATENCY:
+		if len(parts) != 2 && len(parts) != 3 {
+			return f, fmt.Errorf("expected latency:<duration>[:<jitter>]")
+		}
+		var err error
+		f.Latency, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return f, err
+		}
+		if len(parts) == 3 {
+			f.Jitter, err = time.ParseDuration(parts[2])
+			if err != nil {
+				return f, err
+			}
+		}
+	default:
+		return f, fmt.Errorf("unknown fault %q", parts[0])
+	}
+	return f, nil
+}
+
+// parses the fault of a keystore : "17=hang"
+func ParseFaultSpec(value string) (byte, Fault, error) {
+	hsm, spec, ok := strings.Cut(value, "=")
+	if !ok {
+		return 0, Fault{}, fmt.Errorf("expected <keystore>=<fault>")
+	}
+	hsm_number, err := parseHSMNumber(hsm)
+	if err != nil {
+		return 0, Fault{}, err
+	}
+	f, err := ParseFault(spec)
+	if err != nil {
+		return 0, Fault{}, err
+	}
+	return hsm_number, f, nil
+}
+
+func parseHSMNumber(value string) (byte, error) {
+	hsm, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid keystore number %q", value)
+	}
+	return byte(hsm), nil
+}
+
+// faults currently set on a server, by keystore number
+type faults struct {
+	mu    sync.Mutex
+	byHSM map[byte]Fault
+}
+
+// sets the fault of a keystore (FAULT_NONE removes it)
+func (s *Server) SetFault(hsm_number byte, f Fault) {
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+	if f.Kind == FAULT_NONE || f.Kind == "" {
+		delete(s.faults.byHSM, hsm_number)
+	} else {
+		s.faults.byHSM[hsm_number] = f
+	}
+	s.log.Printf("fault of keystore %d : %s\n", hsm_number, f)
+}
+
+// removes the faults of all the keystores
+func (s *Server) ClearFaults() {
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+	s.faults.byHSM = map[byte]Fault{}
+	s.log.Println("all faults removed")
+}
+
+// returns the fault of a keystore (FAULT_NONE if there is none)
+func (s *Server) FaultFor(hsm_number byte) Fault {
+	s.faults.mu.Lock()
+	defer s.faults.mu.Unlock()
+	f, ok := s.faults.byHSM[hsm_number]
+	if !ok {
+		return Fault{Kind: FAULT_NONE}
+	}
+	return f
+}
+
+// latency added by the fault before answering
+func (f Fault) latency() time.Duration {
+	if f.Kind != FAULT_LATENCY {
+		return 0
+	}
+	latency := f.Latency
+	if f.Jitter > 0 {
+		latency += time.Duration(rand.Int63n(int64(f.Jitter)))
+	}
+	return latency
+}
+
+// modifies the answer to a request according to the fault
+func (f Fault) alter(status byte, answer []byte) (byte, []byte) {
+	switch f.Kind {
+	case FAULT_ERROR:
+		return f.Status, nil
+	case FAULT_TRUNCATE:
+		return status, answer[:len(answer)/2]
+	case FAULT_CORRUPT:
+		corrupted := make([]byte, len(answer))
+		for i, b := range answer {
+			corrupted[i] = ^b
+		}
+		return status, corrupted
+	}
+	return status, answer
+}
+
+// HTTP endpoint to change the faults while the server is running
+func (s *Server) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/faults", s.handleFaults)
+	return mux
+}
+
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.faults.mu.Lock()
+		lines := []string{}
+		for hsm_number, f := range s.faults.byHSM {
+			lines = append(lines, fmt.Sprintf("%d=%s", hsm_number, f))
+		}
+		s.faults.mu.Unlock()
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	case http.MethodPut, http.MethodPost:
+		hsm_number, err := parseHSMNumber(r.FormValue("hsm"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := ParseFault(r.FormValue("fault"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.SetFault(hsm_number, f)
+	case http.MethodDelete:
+		if r.FormValue("hsm") == "" {
+			s.ClearFaults()
+			return
+		}
+		hsm_number, err := parseHSMNumber(r.FormValue("hsm"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.SetFault(hsm_number, Fault{Kind: FAULT_NONE})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
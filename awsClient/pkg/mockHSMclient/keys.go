@@ -0,0 +1,148 @@
+package mockHSMclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+/*
+	Master keys of the mock.
+	Each slot (keystore, index) has its own master key, derived from the seed of the mock
+	and the index : all the keystores hold the same key at a given index, as the keystores
+	replicate each other in the real deployment (so a ck created by keystore 17 can be
+	unwrapped by keystore 22, which GetKey relies on).
+
+	A ck is 48 bytes, which leaves no room for a random nonce with AES-GCM (12 + 32 + 16 bytes).
+	The data key is therefore wrapped with a deterministic authenticated encryption (SIV) :
+	  iv = HMAC-SHA256(mac key, [size of context (2 bytes) || context ||] data key)[:16]
+	  ck = iv || AES-256-CTR(enc key, iv, data key)
+	and unwrapping recomputes the iv to authenticate the ck, and the context it is bound to
+	(a ck created without context is only unwrapped without context).
+*/
+
+// seed from which the master keys are derived when Options.Seed is empty
+const DEFAULT_SEED = "mock HSM client master seed"
+
+// executes a request and returns the status and the answer to send to the client
+func (s *Server) processRequest(client string, code byte, hsm_number byte, key_index byte, payload []byte) (byte, []byte) {
+	if int(key_index) >= KEY_INDEXES_PER_KEYSTORE {
+		s.log.Printf("client %s asked for the key at HSM %d index %d, which doesn't exist\n", client, hsm_number, key_index)
+		return KEY_NOT_FOUND_CODE, nil
+	}
+	var context []byte
+	if hasContext[code] {
+		// the data is followed by the size of the context and the context
+		fixed := legacyPayloadSize[code]
+		if len(payload) < fixed+2 || len(payload) != fixed+2+int(binary.BigEndian.Uint16(payload[fixed:])) {
+			s.log.Printf("client %s sent a malformed context (code %d)\n", client, code)
+			return BAD_REQUEST_CODE, nil
+		}
+		context = payload[fixed+2:]
+		payload = payload[:fixed]
+		if len(context) == 0 {
+			// an empty context would give the same ck as a request without context
+			return BAD_REQUEST_CODE, nil
+		}
+	}
+	switch code {
+	case GET_KEY_REQUEST_CODE:
+		// sends the key (here, it's just a 16 bytes hardcoded key)
+		s.log.Printf("client %s asked to get key at HSM %d index %d\n", client, hsm_number, key_index)
+		return GET_KEY_SUCCESS_CODE, mockKey
+	case CREATE_CK_REQUEST_CODE, CREATE_CK_CTX_REQUEST:
+		if len(payload) != DATA_KEY_SIZE {
+			return BAD_REQUEST_CODE, nil
+		}
+		s.log.Printf("client %s asked to create a ck with the key at HSM %d index %d (context %q)\n", client, hsm_number, key_index, context)
+		return GET_KEY_SUCCESS_CODE, s.keys.of(hsm_number, key_index).wrap(context, payload)
+	case GET_K_FROM_CK_REQUEST, GET_K_FROM_CK_CTX_REQUEST:
+		if len(payload) != CK_SIZE {
+			return BAD_REQUEST_CODE, nil
+		}
+		s.log.Printf("client %s asked to unwrap a ck with the key at HSM %d index %d (context %q)\n", client, hsm_number, key_index, context)
+		key, err := s.keys.of(hsm_number, key_index).unwrap(context, payload)
+		if err != nil {
+			s.log.Printf("invalid ck from client %s: %v\n", client, err)
+			return BAD_REQUEST_CODE, nil
+		}
+		return GET_KEY_SUCCESS_CODE, key
+	case TPRF_EVAL_REQUEST:
+		return s.evalTPRF(client, hsm_number, key_index, payload)
+	}
+	s.log.Printf("client %s asked for an unknown request (code %d)\n", client, code)
+	return BAD_REQUEST_CODE, nil
+}
+
+type masterKey struct {
+	encKey []byte
+	macKey []byte
+}
+
+// master keys of a server, created on first use
+type masterKeys struct {
+	seed   []byte
+	mu     sync.Mutex
+	bySlot map[[2]byte]masterKey
+}
+
+func newMasterKeys(seed []byte) masterKeys {
+	return masterKeys{seed: seed, bySlot: map[[2]byte]masterKey{}}
+}
+
+// returns the master key of the slot (keystore, index)
+func (m *masterKeys) of(hsm_number byte, key_index byte) masterKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slot := [2]byte{hsm_number, key_index}
+	mk, ok := m.bySlot[slot]
+	if !ok {
+		derive := func(label string) []byte {
+			mac := hmac.New(sha256.New, m.seed)
+			mac.Write([]byte(label))
+			mac.Write([]byte{key_index})
+			return mac.Sum(nil)
+		}
+		mk = masterKey{encKey: derive("enc"), macKey: derive("mac")}
+		m.bySlot[slot] = mk
+	}
+	return mk
+}
+
+func (mk masterKey) syntheticIV(context []byte, dataKey []byte) []byte {
+	mac := hmac.New(sha256.New, mk.macKey)
+	if len(context) > 0 {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(context))))
+		mac.Write(context)
+	}
+	mac.Write(dataKey)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+func (mk masterKey) ctr(iv []byte, in []byte) []byte {
+	block, err := aes.NewCipher(mk.encKey)
+	if err != nil {
+		panic(err) // the key size is fixed, this can't happen
+	}
+	out := make([]byte, len(in))
+	cipher.NewCTR(block, iv).XORKeyStream(out, in)
+	return out
+}
+
+func (mk masterKey) wrap(context []byte, dataKey []byte) []byte {
+	iv := mk.syntheticIV(context, dataKey)
+	return append(iv, mk.ctr(iv, dataKey)...)
+}
+
+func (mk masterKey) unwrap(context []byte, ck []byte) ([]byte, error) {
+	iv := ck[:aes.BlockSize]
+	dataKey := mk.ctr(iv, ck[aes.BlockSize:])
+	if !hmac.Equal(iv, mk.syntheticIV(context, dataKey)) {
+		return nil, fmt.Errorf("ck authentication failed")
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,421 @@
+package mockHSMclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	Mock HSM client, used to test the AWS client requests.
+	This mock HSM client will listen for incoming requests, read the request code
+	and the next two bytes (keystore, key index on the keystore), and answer
+	after a random amount of milliseconds (< Options.MaxLatency) to simulate the real behaviour of the HSM client :
+	- "get key" (code 0) : returns a hardcoded key
+	- "CreateCk" (code 3) : wraps the 32 bytes data key sent by the client with the master key
+	  of the slot (keystore, index), and returns the 48 bytes ck
+	- "GetKFromCK" (code 4) : unwraps the 48 bytes ck sent by the client and returns the data key
+	- "CreateCkCtx" (code 5) and "GetKFromCKCtx" (code 6) : same as codes 3 and 4, the key (or ck)
+	  being followed by the size of a context on 2 bytes and the context, which is bound to the ck
+	- "EvalTPRF" (code 7) : evaluates the share of the threshold PRF on a blinded element (cf tprf.go)
+	The mock also understands the framed protocol : if the first bytes are the frame magic,
+	it answers the HELLO negotiation and serves framed requests until the client disconnects.
+	With Options.Legacy, it behaves like the HSM clients that predate the framed protocol :
+	it closes the connexion on a HELLO frame, as on any unknown request, without answering.
+	Faults can be injected per keystore (cf faults.go).
+
+	The server can be started from a Go test :
+	  server := mockHSMclient.NewServer(mockHSMclient.Options{})
+	  addr, err := server.Start() // listens on a free port of localhost
+	  defer server.Close()
+	or as a program (cf cmd/mockHSMclient).
+
+	This package doesn't import requestHSMclient, so that the tests of requestHSMclient can use it :
+	the wire formats are implemented a second time here.
+*/
+
+// mock HSM client default port
+const DEFAULT_PORT = "6123"
+
+const (
+	GET_KEY_REQUEST_CODE      byte = 0 // request code for the client HSM (get key)
+	CREATE_CK_REQUEST_CODE    byte = 3 // request code to wrap a data key into a ck
+	GET_K_FROM_CK_REQUEST     byte = 4 // request code to unwrap a ck into the data key
+	CREATE_CK_CTX_REQUEST     byte = 5 // same as CREATE_CK_REQUEST_CODE, with a context bound to the ck
+	GET_K_FROM_CK_CTX_REQUEST byte = 6 // same as GET_K_FROM_CK_REQUEST, with the context bound to the ck
+	GET_KEY_SUCCESS_CODE      byte = 0 // code returned by the HSM client if the key request was successful
+	BAD_REQUEST_CODE          byte = 1 // code returned by the HSM client if the request is malformed or unknown
+	KEY_NOT_FOUND_CODE        byte = 2 // code returned by the HSM client if there is no key at the index
+	DATA_KEY_SIZE                  = 32
+	CK_SIZE                        = 48 // synthetic IV (16 bytes) + encrypted data key (32 bytes)
+	KEY_INDEXES_PER_KEYSTORE       = 32
+)
+
+// framed protocol (cf awsClient/pkg/requestHSMclient/protocol.go) :
+// magic "HK" | version | request id (4 bytes) | length (4 bytes) | code | payload
+const (
+	FRAME_MAGIC_0     byte = 'H'
+	FRAME_MAGIC_1     byte = 'K'
+	FRAME_VERSION     byte = 1
+	FRAME_HEADER_SIZE      = 12
+	MAX_FRAME_PAYLOAD      = 64 * 1024
+	HELLO_CODE        byte = 0xF0
+)
+
+// size of the data sent after [code, keystore, index] in a legacy request
+// (for the requests with a context, size of the data before the context)
+var legacyPayloadSize = map[byte]int{
+	GET_KEY_REQUEST_CODE:      0,
+	CREATE_CK_REQUEST_CODE:    DATA_KEY_SIZE,
+	GET_K_FROM_CK_REQUEST:     CK_SIZE,
+	CREATE_CK_CTX_REQUEST:     DATA_KEY_SIZE,
+	GET_K_FROM_CK_CTX_REQUEST: CK_SIZE,
+	TPRF_EVAL_REQUEST:         TPRF_ELEMENT_SIZE,
+}
+
+// requests whose data is followed by a context (size on 2 bytes, then the context)
+var hasContext = map[byte]bool{
+	CREATE_CK_CTX_REQUEST:     true,
+	GET_K_FROM_CK_CTX_REQUEST: true,
+}
+
+// the hardcoded key returned by the mock (16 bytes)
+var mockKey = []byte{
+	0x01, 0x02, 0x03, 0x04,
+	0x05, 0x06, 0x07, 0x08,
+	0x09, 0x0a, 0x0b, 0x0c,
+	0x0d, 0x0e, 0x0f, 0x10}
+
+type Options struct {
+	Addr          string        // listening address ("localhost:0" if empty : a free port is chosen)
+	TLSConfig     *tls.Config   // listens with TLS if not nil (cf LoadTLSConfig)
+	Seed          []byte        // secret from which the master keys are derived (DEFAULT_SEED if empty)
+	MaxLatency    time.Duration // each answer is delayed by a random latency lower than MaxLatency (none if 0)
+	TPRFThreshold int           // threshold of the sharing of the TPRF keys (DEFAULT_TPRF_THRESHOLD if 0)
+	Legacy        bool          // only speaks the legacy format, and closes the connexion on an unknown request
+	Logger        *log.Logger   // logs of the requests (discarded if nil)
+}
+
+type Server struct {
+	options Options
+	log     *log.Logger
+	keys    masterKeys
+	faults  faults
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// creates a mock HSM client. it doesn't listen until Start is called.
+func NewServer(options Options) *Server {
+	if options.Addr == "" {
+		options.Addr = "localhost:0"
+	}
+	if len(options.Seed) == 0 {
+		options.Seed = []byte(DEFAULT_SEED)
+	}
+	if options.TPRFThreshold <= 0 {
+		options.TPRFThreshold = DEFAULT_TPRF_THRESHOLD
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &Server{
+		options: options,
+		log:     logger,
+		keys:    newMasterKeys(options.Seed),
+		faults:  faults{byHSM: map[byte]Fault{}},
+		conns:   map[net.Conn]struct{}{},
+		closed:  make(chan struct{}),
+	}
+}
+
+// listens on the address of the options and serves the clients in the background.
+// returns the address the server is bound to (with the port chosen if the port was 0).
+func (s *Server) Start() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return "", fmt.Errorf("mock HSM client already started")
+	}
+	ln, err := net.Listen("tcp", s.options.Addr)
+	if err != nil {
+		return "", err
+	}
+	if s.options.TLSConfig != nil {
+		ln = tls.NewListener(ln, s.options.TLSConfig)
+		s.log.Printf("Mock HSM client listening with TLS at address %s...\n", ln.Addr())
+	} else {
+		s.log.Printf("Mock HSM client listening at address %s...\n", ln.Addr())
+	}
+	s.listener = ln
+	s.wg.Add(1)
+	go s.acceptLoop(ln)
+	return ln.Addr().String(), nil
+}
+
+// address the server is bound to (empty before Start)
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// stops listening, closes the connexions of the clients and waits for their handlers to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	close(s.closed)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptLoop(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.log.Println("client failed to connect")
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// registers the connexion so that Close can close it. returns false if the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return false
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	s.log.Printf("Client %s connected.\n", conn.RemoteAddr().String())
+	defer conn.Close()
+
+	// a framed client starts with the magic bytes, a legacy client with the request code
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		if err != io.EOF {
+			s.log.Printf("read error : %v\n", err)
+		}
+		return
+	}
+	if first[0] == FRAME_MAGIC_0 && !s.options.Legacy {
+		s.handleFramedConnection(conn, reader)
+		return
+	}
+
+	// read client request : [code, keystore, index] then the data expected for this code
+	header := make([]byte, 3)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		s.log.Printf("read error : %v\n", err)
+		return
+	}
+	size, ok := legacyPayloadSize[header[0]]
+	if !ok {
+		s.log.Printf("client %s asked for an unknown request (code %d)\n", conn.RemoteAddr().String(), header[0])
+		// like the HSM clients that predate the framed protocol, a legacy mock doesn't answer
+		if !s.options.Legacy {
+			conn.Write([]byte{BAD_REQUEST_CODE})
+		}
+		return
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		s.log.Printf("read error : %v\n", err)
+		return
+	}
+	if hasContext[header[0]] {
+		contextSize := make([]byte, 2)
+		_, err = io.ReadFull(reader, contextSize)
+		if err != nil {
+			s.log.Printf("read error : %v\n", err)
+			return
+		}
+		context := make([]byte, binary.BigEndian.Uint16(contextSize))
+		_, err = io.ReadFull(reader, context)
+		if err != nil {
+			s.log.Printf("read error : %v\n", err)
+			return
+		}
+		payload = append(append(payload, contextSize...), context...)
+	}
+
+	f := s.FaultFor(header[1])
+	if f.Kind == FAULT_REFUSE {
+		s.log.Printf("fault : closing connexion of client %s\n", conn.RemoteAddr().String())
+		return
+	}
+	s.sleep(s.randomLatency() + f.latency())
+	if f.Kind == FAULT_HANG {
+		// no answer, until the client gives up and closes the connexion
+		io.Copy(io.Discard, reader)
+		return
+	}
+
+	status, answer := f.alter(s.processRequest(conn.RemoteAddr().String(), header[0], header[1], header[2], payload))
+	_, err = conn.Write(append([]byte{status}, answer...))
+	if err != nil {
+		s.log.Printf("error answering client %s: %v\n", conn.RemoteAddr().String(), err)
+	}
+}
+
+// random latency simulating the real HSM client behaviour
+func (s *Server) randomLatency() time.Duration {
+	if s.options.MaxLatency <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.options.MaxLatency)))
+}
+
+// sleeps, unless the server is closed in the meantime
+func (s *Server) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.closed:
+	}
+}
+
+// serves framed requests on the connexion until the client closes it.
+// requests are processed concurrently (the client can pipeline them),
+// the answers are matched to the requests by their request id.
+func (s *Server) handleFramedConnection(conn net.Conn, reader *bufio.Reader) {
+	client := conn.RemoteAddr().String()
+	var writeMu sync.Mutex
+	answer := func(requestID uint32, status byte, payload []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		err := writeFrame(conn, requestID, status, payload)
+		if err != nil {
+			s.log.Printf("error answering client %s: %v\n", client, err)
+		}
+	}
+	var requests sync.WaitGroup
+	defer requests.Wait()
+
+	header := make([]byte, FRAME_HEADER_SIZE)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.log.Printf("read error : %v\n", err)
+			}
+			return
+		}
+		if header[0] != FRAME_MAGIC_0 || header[1] != FRAME_MAGIC_1 {
+			s.log.Printf("client %s sent a malformed frame\n", client)
+			return
+		}
+		requestID := binary.BigEndian.Uint32(header[3:7])
+		length := binary.BigEndian.Uint32(header[7:11])
+		code := header[11]
+		if length > MAX_FRAME_PAYLOAD {
+			s.log.Printf("client %s sent a too large frame (%d bytes)\n", client, length)
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			s.log.Printf("read error : %v\n", err)
+			return
+		}
+
+		switch {
+		case code == HELLO_CODE:
+			// negotiation and health checks
+			answer(requestID, HELLO_CODE, nil)
+		case len(payload) >= 2:
+			requests.Add(1)
+			go func() {
+				defer requests.Done()
+				f := s.FaultFor(payload[0])
+				if f.Kind == FAULT_REFUSE {
+					s.log.Printf("fault : closing connexion of client %s\n", client)
+					conn.Close()
+					return
+				}
+				s.sleep(s.randomLatency() + f.latency())
+				if f.Kind == FAULT_HANG {
+					return
+				}
+				status, key := f.alter(s.processRequest(client, code, payload[0], payload[1], payload[2:]))
+				answer(requestID, status, key)
+			}()
+		default:
+			s.log.Printf("client %s sent a request without keystore and index (code %d)\n", client, code)
+			answer(requestID, BAD_REQUEST_CODE, nil)
+		}
+	}
+}
+
+func writeFrame(conn net.Conn, requestID uint32, code byte, payload []byte) error {
+	buf := make([]byte, FRAME_HEADER_SIZE+len(payload))
+	buf[0], buf[1], buf[2] = FRAME_MAGIC_0, FRAME_MAGIC_1, FRAME_VERSION
+	binary.BigEndian.PutUint32(buf[3:7], requestID)
+	binary.BigEndian.PutUint32(buf[7:11], uint32(len(payload)))
+	buf[11] = code
+	copy(buf[FRAME_HEADER_SIZE:], payload)
+	_, err := conn.Write(buf)
+	return err
+}
@@ -0,0 +1,75 @@
+package mockHSMclient
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+)
+
+/*
+	Threshold PRF of the mock (cf awsClient/pkg/requestHSMclient/tprf.go).
+	At each index, the PRF key s is shared with a polynomial f of degree Options.TPRFThreshold-1
+	whose coefficients are derived from the seed and the index : the keystore i holds the share f(i),
+	so that any TPRFThreshold keystores give the same data key.
+	A "EvalTPRF" request (code 7) carries a blinded group element a (256 bytes),
+	and the keystore i answers a^f(i) mod p.
+*/
+
+const (
+	TPRF_EVAL_REQUEST      byte = 7 // request code of a partial evaluation of the threshold PRF
+	TPRF_ELEMENT_SIZE           = 256
+	DEFAULT_TPRF_THRESHOLD      = 2
+)
+
+// prime of the 2048 bits MODP group of RFC 3526
+const tprfPrime = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var (
+	tprfP, _ = new(big.Int).SetString(tprfPrime, 16)
+	tprfQ    = new(big.Int).Rsh(tprfP, 1)
+)
+
+// share of the keystore at the index : f(hsm_number) mod q
+func (s *Server) tprfShare(hsm_number byte, key_index byte) *big.Int {
+	x := big.NewInt(int64(hsm_number))
+	share := new(big.Int)
+	// Horner evaluation, from the coefficient of highest degree
+	for degree := s.options.TPRFThreshold - 1; degree >= 0; degree-- {
+		mac := hmac.New(sha256.New, s.options.Seed)
+		mac.Write([]byte("tprf"))
+		mac.Write([]byte{key_index, byte(degree)})
+		first := mac.Sum(nil)
+		mac.Write([]byte{0xff})
+		coefficient := new(big.Int).SetBytes(mac.Sum(first)) // 512 bits, reduced modulo q
+		share.Mul(share, x)
+		share.Add(share, coefficient)
+		share.Mod(share, tprfQ)
+	}
+	return share
+}
+
+// evaluates the share of the keystore on the blinded element of the client
+func (s *Server) evalTPRF(client string, hsm_number byte, key_index byte, payload []byte) (byte, []byte) {
+	if hsm_number == 0 || len(payload) != TPRF_ELEMENT_SIZE {
+		return BAD_REQUEST_CODE, nil
+	}
+	a := new(big.Int).SetBytes(payload)
+	// the element must be a quadratic residue other than 1
+	if a.Cmp(big.NewInt(1)) <= 0 || a.Cmp(tprfP) >= 0 || new(big.Int).Exp(a, tprfQ, tprfP).Cmp(big.NewInt(1)) != 0 {
+		s.log.Printf("client %s sent an invalid TPRF element\n", client)
+		return BAD_REQUEST_CODE, nil
+	}
+	s.log.Printf("client %s asked for a TPRF evaluation with the share at HSM %d index %d\n", client, hsm_number, key_index)
+	answer := a.Exp(a, s.tprfShare(hsm_number, key_index), tprfP)
+	return GET_KEY_SUCCESS_CODE, answer.FillBytes(make([]byte, TPRF_ELEMENT_SIZE))
+}
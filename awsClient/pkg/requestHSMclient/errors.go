@@ -0,0 +1,65 @@
+package requestHSMclient
+
+import (
+	"errors"
+	"fmt"
+)
+
+// status codes returned by the HSM client in the first byte of the answer
+// (legacy format) or in the code of the answer frame (framed format).
+// GET_KEY_SUCCESS_CODE (0) means the request succeeded.
+const (
+	STATUS_BAD_REQUEST     byte = 1 // the request is malformed or the action is unknown
+	STATUS_KEY_NOT_FOUND   byte = 2 // there is no key at the given index on the HSM
+	STATUS_SLOT_LOCKED     byte = 3 // the key slot exists but can't be used at the moment
+	STATUS_HSM_UNAVAILABLE byte = 4 // the HSM client can't reach the HSM
+	STATUS_AUTH_FAILURE    byte = 5 // the HSM client or the HSM refused to authenticate the request
+)
+
+// errors returned by the key requests, to be tested with errors.Is
+var (
+	ErrBadRequest     = errors.New("bad request")
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrSlotLocked     = errors.New("key slot locked")
+	ErrHSMUnavailable = errors.New("HSM unavailable")
+	ErrAuthFailure    = errors.New("authentication failure")
+	ErrRequestFailed  = errors.New("request failed")                  // unknown status code
+	ErrKeyMismatch    = errors.New("the HSM returned different keys") // POLICY_BOTH_AGREE
+	ErrThreshold      = errors.New("not enough HSM answered")         // TPRF evaluation (cf tprf.go)
+)
+
+var statusErrors = map[byte]error{
+	STATUS_BAD_REQUEST:     ErrBadRequest,
+	STATUS_KEY_NOT_FOUND:   ErrKeyNotFound,
+	STATUS_SLOT_LOCKED:     ErrSlotLocked,
+	STATUS_HSM_UNAVAILABLE: ErrHSMUnavailable,
+	STATUS_AUTH_FAILURE:    ErrAuthFailure,
+}
+
+// error returned when the HSM client answered with a status other than GET_KEY_SUCCESS_CODE
+type HSMError struct {
+	Status byte
+	KeyHSM KeyHSM
+	Err    error // one of the errors above
+}
+
+func (e *HSMError) Error() string {
+	return fmt.Sprintf("the HSM client returned that the key request at HSM %d index %d failed (status %d): %v", e.KeyHSM.Hsm_number, e.KeyHSM.Key_index, e.Status, e.Err)
+}
+
+func (e *HSMError) Unwrap() error {
+	return e.Err
+}
+
+// decodes the status returned by the HSM client.
+// returns nil if the request succeeded, an *HSMError otherwise.
+func StatusError(status byte, keyHSM KeyHSM) error {
+	if status == GET_KEY_SUCCESS_CODE {
+		return nil
+	}
+	err, ok := statusErrors[status]
+	if !ok {
+		err = ErrRequestFailed
+	}
+	return &HSMError{Status: status, KeyHSM: keyHSM, Err: err}
+}
@@ -0,0 +1,263 @@
+package requestHSMclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Failover between the HSM client addresses of a replica.
+
+	A keystore can be reached through several HSM clients (Replica.Addresses, the address
+	given to GetKey if empty). The request to a replica is sent to one of its addresses,
+	and retried on the next one after an exponential backoff if the HSM client failed
+	(connexion refused or lost, no answer within AttemptTimeout, HSM unavailable...). An error status
+	such as "key not found" is returned without retrying : another HSM client would
+	give the same answer.
+
+	The health of every address is tracked passively, from the outcome of the requests
+	(a request cancelled by the caller, or stopped by the caller's deadline, isn't an outcome) :
+	- the addresses are tried from the healthiest to the least healthy
+	- after BreakerThreshold consecutive failures, the circuit breaker of the address opens :
+	  it is skipped for BreakerCooldown, so that a dead HSM client doesn't slow every request.
+	  then a single request is let through (half-open) : if it succeeds the circuit closes,
+	  otherwise it opens again.
+	If the circuits of every address of a replica are open, the request fails at once with ErrCircuitOpen.
+*/
+
+const (
+	DEFAULT_MAX_RETRIES       = 2 // retries after the first attempt on a replica
+	DEFAULT_RETRY_BACKOFF     = 50 * time.Millisecond
+	MAX_RETRY_BACKOFF         = time.Second
+	DEFAULT_ATTEMPT_TIMEOUT   = 3 * time.Second // a hung HSM client leaves time to retry on another one
+	DEFAULT_BREAKER_THRESHOLD = 3               // consecutive failures opening the circuit of an address
+	DEFAULT_BREAKER_COOLDOWN  = 5 * time.Second
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// health of an HSM client address
+type endpointHealth struct {
+	failures  int       // consecutive failures
+	openUntil time.Time // the circuit is open until then, if failures >= threshold
+	probing   bool      // half-open : a request is testing the address
+}
+
+type healthTracker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointHealth
+}
+
+func newHealthTracker(threshold int, cooldown time.Duration) *healthTracker {
+	return &healthTracker{threshold: threshold, cooldown: cooldown, endpoints: map[string]*endpointHealth{}}
+}
+
+func (t *healthTracker) get(addr string) *endpointHealth {
+	h, ok := t.endpoints[addr]
+	if !ok {
+		h = &endpointHealth{}
+		t.endpoints[addr] = h
+	}
+	return h
+}
+
+// sorts the addresses from the healthiest to the least healthy (stable : the order
+// of the configuration is kept between addresses as healthy as each other)
+func (t *healthTracker) order(addrs []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ordered := append([]string{}, addrs...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return t.get(ordered[i]).failures < t.get(ordered[j]).failures
+	})
+	return ordered
+}
+
+// tells if a request can be sent to the address. if the cooldown of an open circuit is over,
+// the first caller is let through to test the address (and must report its outcome).
+func (t *healthTracker) allow(addr string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(addr)
+	if h.failures < t.threshold {
+		return true
+	}
+	if time.Now().Before(h.openUntil) || h.probing {
+		return false
+	}
+	h.probing = true
+	return true
+}
+
+func (t *healthTracker) success(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(addr)
+	h.failures = 0
+	h.probing = false
+}
+
+func (t *healthTracker) failure(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.get(addr)
+	h.failures++
+	h.probing = false
+	if h.failures >= t.threshold {
+		h.openUntil = time.Now().Add(t.cooldown)
+	}
+}
+
+// the request was cancelled : nothing is learnt about the address
+func (t *healthTracker) release(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(addr).probing = false
+}
+
+// retries and health tracking of the requests to the replicas
+type failover struct {
+	maxRetries     int
+	backoff        time.Duration
+	attemptTimeout time.Duration
+	health         *healthTracker
+}
+
+// builds the failover from the options (zero values replaced by the defaults, negative MaxRetries : no retry)
+func newFailover(options HSMClientOptions) *failover {
+	f := &failover{
+		maxRetries:     options.MaxRetries,
+		backoff:        options.RetryBackoff,
+		attemptTimeout: options.AttemptTimeout,
+	}
+	if f.maxRetries == 0 {
+		f.maxRetries = DEFAULT_MAX_RETRIES
+	} else if f.maxRetries < 0 {
+		f.maxRetries = 0
+	}
+	if f.backoff <= 0 {
+		f.backoff = DEFAULT_RETRY_BACKOFF
+	}
+	if f.attemptTimeout <= 0 {
+		f.attemptTimeout = DEFAULT_ATTEMPT_TIMEOUT
+	}
+	threshold := options.BreakerThreshold
+	if threshold <= 0 {
+		threshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	cooldown := options.BreakerCooldown
+	if cooldown <= 0 {
+		cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	f.health = newHealthTracker(threshold, cooldown)
+	return f
+}
+
+// failover of the package functions (GetKey, GetKeyContext)
+var defaultFailover = newFailover(HSMClientOptions{})
+
+// sends the request to the replica through its HSM client addresses (hsm_client_addr if it has none),
+// retrying on the next address when the HSM client fails
+func (f *failover) getKey(ctx context.Context, hsm_client_addr string, replica Replica, getKeyFromHSM func(ctx context.Context, hsm_client_addr string, keyHSM KeyHSM) ([]byte, error)) resGetKey {
+	addrs := replica.Addresses
+	if len(addrs) == 0 {
+		addrs = []string{hsm_client_addr}
+	}
+	errs := []error{}
+	tried := map[string]bool{}
+	backoff := f.backoff
+	for attempt := 0; attempt <= f.maxRetries; attempt++ {
+		if attempt > 0 {
+			// exponential backoff, with jitter so that the clients don't retry all together
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			backoff = min(2*backoff, MAX_RETRY_BACKOFF)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				errs = append(errs, ctx.Err())
+				return resGetKey{key: []byte{}, err: errors.Join(errs...)}
+			}
+		}
+
+		addr, ok := f.pick(addrs, tried)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%w: %w: every HSM client of HSM %d is failing (%s)", ErrHSMUnavailable, ErrCircuitOpen, replica.Hsm_number, strings.Join(addrs, ", ")))
+			break
+		}
+		tried[addr] = true
+
+		attemptCtx, cancel := context.WithTimeout(ctx, f.attemptTimeout)
+		key, err := getKeyFromHSM(attemptCtx, addr, replica.KeyHSM)
+		cancel()
+		switch {
+		case err == nil:
+			f.health.success(addr)
+			return resGetKey{key: key, err: nil}
+		case ctx.Err() != nil:
+			// request cancelled by the caller (another replica answered first), or out of the caller's time :
+			// the HSM client didn't fail, only an attempt timing out on its own counts
+			f.health.release(addr)
+			errs = append(errs, err)
+			return resGetKey{key: []byte{}, err: errors.Join(errs...)}
+		case isEndpointFailure(err):
+			f.health.failure(addr)
+		default:
+			// the HSM client answered : it is healthy
+			f.health.success(addr)
+		}
+		if len(addrs) > 1 {
+			err = fmt.Errorf("HSM client %s: %w", addr, err)
+		}
+		errs = append(errs, err)
+		if !isRetryable(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return resGetKey{key: []byte{}, err: errors.Join(errs...)}
+}
+
+// returns the healthiest address that accepts requests, preferring the ones not tried yet
+func (f *failover) pick(addrs []string, tried map[string]bool) (string, bool) {
+	ordered := f.health.order(addrs)
+	for _, untriedOnly := range []bool{true, false} {
+		for _, addr := range ordered {
+			if untriedOnly && tried[addr] {
+				continue
+			}
+			if f.health.allow(addr) {
+				return addr, true
+			}
+		}
+	}
+	return "", false
+}
+
+// tells if the error shows that the HSM client itself failed
+// (an error status means it answered, an invalid action is our fault)
+func isEndpointFailure(err error) bool {
+	var hsmErr *HSMError
+	if errors.As(err, &hsmErr) {
+		return false
+	}
+	return !errors.Is(err, ErrBadRequest) && !errors.Is(err, ErrClientClosed)
+}
+
+// tells if the request can succeed through another HSM client, or later
+func isRetryable(err error) bool {
+	var hsmErr *HSMError
+	if errors.As(err, &hsmErr) {
+		return errors.Is(err, ErrSlotLocked) || errors.Is(err, ErrHSMUnavailable)
+	}
+	return !errors.Is(err, ErrBadRequest) && !errors.Is(err, ErrClientClosed) && !errors.Is(err, ErrCircuitOpen)
+}
@@ -0,0 +1,173 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+// address on which nothing listens
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestFailoverNextAddress(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	dead := deadAddress(t)
+	c := newTestClient(t, HSMClientOptions{RetryBackoff: time.Millisecond})
+	replicas := []Replica{{KeyHSM: KeyHSM{17, 1}, Addresses: []string{dead, addr}}}
+
+	k := testDataKey(3)
+	ck, err := c.GetKey(context.Background(), "", replicas, "CreateCk", k)
+	if err != nil {
+		t.Fatalf("the request wasn't retried on the second address: %v", err)
+	}
+	got, err := c.GetKey(context.Background(), "", replicas, "GetKFromCK", ck)
+	if err != nil || !bytes.Equal(got, k) {
+		t.Fatalf("got %x (%v), want %x", got, err, k)
+	}
+}
+
+func TestFailoverRetries(t *testing.T) {
+	f := newFailover(HSMClientOptions{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	replica := Replica{KeyHSM: KeyHSM{17, 1}}
+
+	// an HSM client failure is retried
+	attempts := 0
+	res := f.getKey(context.Background(), "a:1", replica, func(ctx context.Context, addr string, keyHSM KeyHSM) ([]byte, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, fmt.Errorf("%w: connexion lost", ErrHSMUnavailable)
+		}
+		return []byte("k"), nil
+	})
+	if res.err != nil || attempts != 3 {
+		t.Fatalf("got %v after %d attempts, want a key after 3", res.err, attempts)
+	}
+
+	// an error status of the HSM isn't retried : another HSM client would give the same answer
+	attempts = 0
+	res = f.getKey(context.Background(), "b:1", replica, func(ctx context.Context, addr string, keyHSM KeyHSM) ([]byte, error) {
+		attempts++
+		return nil, StatusError(STATUS_KEY_NOT_FOUND, keyHSM)
+	})
+	if !errors.Is(res.err, ErrKeyNotFound) || attempts != 1 {
+		t.Fatalf("got %v after %d attempts, want ErrKeyNotFound after 1", res.err, attempts)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	f := newFailover(HSMClientOptions{MaxRetries: -1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	replica := Replica{KeyHSM: KeyHSM{17, 1}}
+	attempts := 0
+	failing := func(ctx context.Context, addr string, keyHSM KeyHSM) ([]byte, error) {
+		attempts++
+		return nil, fmt.Errorf("%w: connexion refused", ErrHSMUnavailable)
+	}
+	working := func(ctx context.Context, addr string, keyHSM KeyHSM) ([]byte, error) {
+		attempts++
+		return []byte("k"), nil
+	}
+
+	for range 2 {
+		f.getKey(context.Background(), "a:1", replica, failing)
+	}
+	// the circuit is open : the address isn't tried
+	attempts = 0
+	res := f.getKey(context.Background(), "a:1", replica, working)
+	if !errors.Is(res.err, ErrCircuitOpen) || !errors.Is(res.err, ErrHSMUnavailable) || attempts != 0 {
+		t.Fatalf("got %v after %d attempts, want ErrCircuitOpen without attempt", res.err, attempts)
+	}
+
+	// after the cooldown, a single request tests the address
+	time.Sleep(60 * time.Millisecond)
+	if !f.health.allow("a:1") {
+		t.Fatalf("the address isn't tested after the cooldown")
+	}
+	if f.health.allow("a:1") {
+		t.Fatalf("two requests let through while the circuit is half-open")
+	}
+	f.health.success("a:1")
+	res = f.getKey(context.Background(), "a:1", replica, working)
+	if res.err != nil {
+		t.Fatalf("the circuit didn't close after a success: %v", res.err)
+	}
+
+	// a failing half-open request opens the circuit again
+	for range 2 {
+		f.getKey(context.Background(), "a:1", replica, failing)
+	}
+	time.Sleep(60 * time.Millisecond)
+	f.getKey(context.Background(), "a:1", replica, failing)
+	if f.health.allow("a:1") {
+		t.Fatalf("the circuit didn't open again after a failed test")
+	}
+}
+
+// a request cancelled or stopped by the caller's deadline isn't a failure of the HSM client,
+// a request stopped by the attempt timeout is
+func TestFailoverCallerCancellation(t *testing.T) {
+	f := newFailover(HSMClientOptions{MaxRetries: -1, BreakerThreshold: 1, AttemptTimeout: time.Second})
+	replica := Replica{KeyHSM: KeyHSM{17, 1}}
+	hung := func(ctx context.Context, addr string, keyHSM KeyHSM) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	f.getKey(cancelled, "a:1", replica, hung)
+	expired, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	f.getKey(expired, "a:1", replica, hung)
+	if !f.health.allow("a:1") {
+		t.Fatalf("circuit opened by requests ended by the caller")
+	}
+
+	f.attemptTimeout = 10 * time.Millisecond
+	f.getKey(context.Background(), "a:1", replica, hung)
+	if f.health.allow("a:1") {
+		t.Fatalf("circuit still closed after an attempt timeout")
+	}
+}
+
+// the slow replicas cancelled by the hedged policy keep a closed circuit
+func TestHedgedLosersKeepTheirCircuit(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{})
+	c := newTestClient(t, HSMClientOptions{Policy: POLICY_HEDGED, HedgeDelay: 10 * time.Millisecond, BreakerThreshold: 1})
+	// the second replica through another name of the mock, so that each address has its own circuit
+	_, port, _ := net.SplitHostPort(addr)
+	slow := []Replica{{KeyHSM: KeyHSM{17, 1}, Addresses: []string{addr}}, {KeyHSM: KeyHSM{22, 1}, Addresses: []string{net.JoinHostPort("localhost", port)}}}
+	server.SetFault(17, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_LATENCY, Latency: 200 * time.Millisecond})
+
+	for range 3 {
+		if _, err := c.GetKey(context.Background(), "", slow, "CreateCk", testDataKey(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.failover.health.allow(addr) {
+		t.Fatalf("circuit of the slow HSM client opened by the hedged requests")
+	}
+}
+
+func TestHealthOrder(t *testing.T) {
+	tracker := newHealthTracker(10, time.Second)
+	tracker.failure("a:1")
+	got := tracker.order([]string{"a:1", "b:1", "c:1"})
+	if got[0] != "b:1" || got[1] != "c:1" || got[2] != "a:1" {
+		t.Fatalf("got %v, want the failing address last", got)
+	}
+}
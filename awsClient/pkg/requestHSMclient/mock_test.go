@@ -0,0 +1,40 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"testing"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+// starts a mock HSM client on a free port of localhost, closed at the end of the test
+func startMock(t *testing.T, options mockHSMclient.Options) (*mockHSMclient.Server, string) {
+	t.Helper()
+	server := mockHSMclient.NewServer(options)
+	addr, err := server.Start()
+	if err != nil {
+		t.Fatalf("couldn't start the mock HSM client: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, addr
+}
+
+// creates an HSMClient closed at the end of the test
+func newTestClient(t *testing.T, options HSMClientOptions) *HSMClient {
+	t.Helper()
+	c := NewHSMClient(options)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// sets the protocol for the test, and negotiates again with every address afterwards
+func setTestProtocol(t *testing.T, p Protocol) {
+	t.Helper()
+	SetProtocol(p)
+	t.Cleanup(func() { SetProtocol(PROTOCOL_AUTO) })
+}
+
+// a 32 bytes data key
+func testDataKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
@@ -0,0 +1,247 @@
+package requestHSMclient
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"time"
+)
+
+/*
+	Policies of the key requests sent to the HSM holding a replica of the key.
+	The replicas are ordered by priority (lowest first), and at random in proportion
+	to their weight among the replicas of the same priority (cf orderReplicas) :
+	- first-success : the replicas of the best priority are queried in parallel, and the first
+	  key retrieved is returned. the next priority is only queried if they all failed.
+	- hedged : the first replica (primary) is queried, and the next one only if the previous
+	  fails or hasn't answered within the hedge delay. the first key retrieved is returned.
+	- both-agree : the first two replicas (best priority first) are queried in parallel, and must return
+	  the same key (or ck), which detects a corrupted answer or keystores out of sync.
+	  a replica that fails is replaced by the next one, so a backup that is down doesn't fail the request.
+	With every policy, the requests still running when the key is returned (or when the
+	request fails) are cancelled.
+*/
+
+type Policy int
+
+const (
+	POLICY_FIRST_SUCCESS Policy = iota
+	POLICY_HEDGED
+	POLICY_BOTH_AGREE
+)
+
+// delay before querying the next replica with POLICY_HEDGED, when none is given
+const DEFAULT_HEDGE_DELAY = 200 * time.Millisecond
+
+// number of replicas whose keys are compared with POLICY_BOTH_AGREE
+const AGREEING_REPLICAS = 2
+
+func (p Policy) String() string {
+	switch p {
+	case POLICY_FIRST_SUCCESS:
+		return "first-success"
+	case POLICY_HEDGED:
+		return "hedged"
+	case POLICY_BOTH_AGREE:
+		return "both-agree"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// parses a policy name as given on the command line ("first-success", "hedged" or "both-agree")
+func ParsePolicy(name string) (Policy, error) {
+	for _, p := range []Policy{POLICY_FIRST_SUCCESS, POLICY_HEDGED, POLICY_BOTH_AGREE} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return POLICY_FIRST_SUCCESS, fmt.Errorf("unknown HSM request policy %q (expected first-success, hedged or both-agree)", name)
+}
+
+// runs the key request on the HSM according to the policy.
+// if the context has no deadline, DEFAULT_REQUEST_TIMEOUT is applied.
+// (shared by GetKeyContext and HSMClient.GetKey)
+func getKeyWithPolicy(ctx context.Context, policy Policy, hedgeDelay time.Duration, replicas []Replica, getKeyFromHSM func(context.Context, Replica) resGetKey) ([]byte, error) {
+	if len(replicas) == 0 {
+		return []byte{}, fmt.Errorf("%w: no key replica to query", ErrBadRequest)
+	}
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); ok {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, DEFAULT_REQUEST_TIMEOUT)
+	}
+	// cancels the requests still running when we return
+	defer cancel()
+
+	groups := orderReplicas(replicas)
+	switch policy {
+	case POLICY_HEDGED:
+		if hedgeDelay <= 0 {
+			hedgeDelay = DEFAULT_HEDGE_DELAY
+		}
+		return getKeyHedged(ctx, hedgeDelay, slices.Concat(groups...), getKeyFromHSM)
+	case POLICY_BOTH_AGREE:
+		return getKeyAgreed(ctx, slices.Concat(groups...), getKeyFromHSM)
+	}
+
+	errs := []error{}
+	for _, group := range groups {
+		key, groupErrs := getKeyFirstSuccess(ctx, group, getKeyFromHSM)
+		if groupErrs == nil {
+			return key, nil
+		}
+		errs = append(errs, groupErrs...)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return []byte{}, fmt.Errorf("key request failed on every HSM: %w", errors.Join(errs...))
+}
+
+// sorts the replicas by priority, and returns the groups of replicas of the same priority.
+// in a group, the replicas are shuffled so that a replica comes first with a probability
+// proportional to its weight (weighted random sampling, with exponential keys).
+func orderReplicas(replicas []Replica) [][]Replica {
+	type ranked struct {
+		replica Replica
+		rank    float64
+	}
+	ranks := make([]ranked, 0, len(replicas))
+	for _, replica := range replicas {
+		weight := replica.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		ranks = append(ranks, ranked{replica, rand.ExpFloat64() / float64(weight)})
+	}
+	sort.Slice(ranks, func(i, j int) bool {
+		if ranks[i].replica.Priority != ranks[j].replica.Priority {
+			return ranks[i].replica.Priority < ranks[j].replica.Priority
+		}
+		return ranks[i].rank < ranks[j].rank
+	})
+
+	groups := [][]Replica{}
+	for i, r := range ranks {
+		if i == 0 || r.replica.Priority != ranks[i-1].replica.Priority {
+			groups = append(groups, []Replica{})
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], r.replica)
+	}
+	return groups
+}
+
+// queries the HSM in parallel and returns the first key retrieved,
+// or the errors of every request if they all failed
+func getKeyFirstSuccess(ctx context.Context, replicas []Replica, getKeyFromHSM func(context.Context, Replica) resGetKey) ([]byte, []error) {
+	// channel to retrieve HSM request results (key + eventual error)
+	return_values := make(chan resGetKey, len(replicas))
+	for _, replica := range replicas {
+		go func() {
+			return_values <- getKeyFromHSM(ctx, replica)
+		}()
+	}
+	errs := []error{}
+	for range replicas {
+		res := <-return_values
+		if res.err != nil {
+			// we can't return this error yet as if another request succeeds we ignore it
+			errs = append(errs, res.err)
+			continue
+		}
+		return res.key, nil
+	}
+	return []byte{}, errs
+}
+
+// queries the HSM one after the other : the next one is queried when the previous
+// request failed, or didn't answer within hedgeDelay (it is then still awaited)
+func getKeyHedged(ctx context.Context, hedgeDelay time.Duration, replicas []Replica, getKeyFromHSM func(context.Context, Replica) resGetKey) ([]byte, error) {
+	return_values := make(chan resGetKey, len(replicas))
+	started, pending := 0, 0
+	startNext := func() {
+		replica := replicas[started]
+		started++
+		pending++
+		go func() {
+			return_values <- getKeyFromHSM(ctx, replica)
+		}()
+	}
+
+	timer := time.NewTimer(hedgeDelay)
+	defer timer.Stop()
+	startNext()
+	errs := []error{}
+	for pending > 0 {
+		select {
+		case res := <-return_values:
+			pending--
+			if res.err == nil {
+				return res.key, nil
+			}
+			errs = append(errs, res.err)
+			// no need to wait for the hedge delay after a failure
+			if started < len(replicas) {
+				startNext()
+				timer.Reset(hedgeDelay)
+			}
+		case <-timer.C:
+			if started < len(replicas) {
+				startNext()
+				timer.Reset(hedgeDelay)
+			}
+		}
+	}
+	return []byte{}, fmt.Errorf("key request failed on every HSM: %w", errors.Join(errs...))
+}
+
+// queries the first AGREEING_REPLICAS HSM in parallel and returns the key if they returned the same one.
+// a request that fails is replaced by a request to the next HSM.
+func getKeyAgreed(ctx context.Context, replicas []Replica, getKeyFromHSM func(context.Context, Replica) resGetKey) ([]byte, error) {
+	type result struct {
+		replica Replica
+		resGetKey
+	}
+	needed := min(AGREEING_REPLICAS, len(replicas))
+	return_values := make(chan result, len(replicas))
+	started, pending := 0, 0
+	startNext := func() {
+		replica := replicas[started]
+		started++
+		pending++
+		go func() {
+			return_values <- result{replica, getKeyFromHSM(ctx, replica)}
+		}()
+	}
+
+	for started < needed {
+		startNext()
+	}
+	agreed := []result{}
+	errs := []error{}
+	for pending > 0 {
+		res := <-return_values
+		pending--
+		if res.err != nil {
+			errs = append(errs, res.err)
+			if started < len(replicas) {
+				startNext()
+			}
+			continue
+		}
+		if len(agreed) > 0 && subtle.ConstantTimeCompare(agreed[0].key, res.key) != 1 {
+			// the other requests are cancelled
+			return []byte{}, fmt.Errorf("%w: HSM %d and HSM %d", ErrKeyMismatch, agreed[0].replica.Hsm_number, res.replica.Hsm_number)
+		}
+		agreed = append(agreed, res)
+		if len(agreed) == needed {
+			return agreed[0].key, nil
+		}
+	}
+	return []byte{}, fmt.Errorf("key request must succeed on %d HSM (%s policy): %w", needed, POLICY_BOTH_AGREE, errors.Join(errs...))
+}
@@ -0,0 +1,197 @@
+package requestHSMclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fake HSM : the key returned by each HSM number, the HSM missing from keys fail
+type fakeHSM struct {
+	keys  map[int]string
+	delay map[int]time.Duration
+
+	mu      sync.Mutex
+	queried []int
+}
+
+func (f *fakeHSM) getKey(ctx context.Context, replica Replica) resGetKey {
+	f.mu.Lock()
+	f.queried = append(f.queried, replica.Hsm_number)
+	f.mu.Unlock()
+	select {
+	case <-time.After(f.delay[replica.Hsm_number]):
+	case <-ctx.Done():
+		return resGetKey{key: []byte{}, err: ctx.Err()}
+	}
+	key, ok := f.keys[replica.Hsm_number]
+	if !ok {
+		return resGetKey{key: []byte{}, err: &HSMError{Status: STATUS_HSM_UNAVAILABLE, KeyHSM: replica.KeyHSM, Err: ErrHSMUnavailable}}
+	}
+	return resGetKey{key: []byte(key), err: nil}
+}
+
+func (f *fakeHSM) wasQueried(hsm_number int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, queried := range f.queried {
+		if queried == hsm_number {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPolicyFirstSuccess(t *testing.T) {
+	replicas := []Replica{
+		{KeyHSM: KeyHSM{17, 1}},
+		{KeyHSM: KeyHSM{22, 1}},
+		{KeyHSM: KeyHSM{23, 1}, Priority: 1},
+	}
+	// 17 fails, 22 answers : 23 (next priority) isn't queried
+	hsm := &fakeHSM{keys: map[int]string{22: "k22", 23: "k23"}}
+	key, err := getKeyWithPolicy(context.Background(), POLICY_FIRST_SUCCESS, 0, replicas, hsm.getKey)
+	if err != nil || string(key) != "k22" {
+		t.Fatalf("got %q (%v), want k22", key, err)
+	}
+	if hsm.wasQueried(23) {
+		t.Fatalf("the replica of priority 1 was queried although one of priority 0 answered")
+	}
+
+	// the replicas of priority 0 fail : the next priority is queried
+	hsm = &fakeHSM{keys: map[int]string{23: "k23"}}
+	key, err = getKeyWithPolicy(context.Background(), POLICY_FIRST_SUCCESS, 0, replicas, hsm.getKey)
+	if err != nil || string(key) != "k23" {
+		t.Fatalf("got %q (%v), want k23", key, err)
+	}
+
+	// every replica fails : the errors are joined
+	hsm = &fakeHSM{keys: map[int]string{}}
+	_, err = getKeyWithPolicy(context.Background(), POLICY_FIRST_SUCCESS, 0, replicas, hsm.getKey)
+	if !errors.Is(err, ErrHSMUnavailable) {
+		t.Fatalf("got %v, want ErrHSMUnavailable", err)
+	}
+
+	if _, err := getKeyWithPolicy(context.Background(), POLICY_FIRST_SUCCESS, 0, nil, hsm.getKey); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("got %v without replicas, want ErrBadRequest", err)
+	}
+}
+
+func TestPolicyHedged(t *testing.T) {
+	replicas := []Replica{
+		{KeyHSM: KeyHSM{17, 1}},
+		{KeyHSM: KeyHSM{22, 1}, Priority: 1},
+	}
+	// the primary answers within the hedge delay : the second replica isn't queried
+	hsm := &fakeHSM{keys: map[int]string{17: "k17", 22: "k22"}}
+	key, err := getKeyWithPolicy(context.Background(), POLICY_HEDGED, time.Second, replicas, hsm.getKey)
+	if err != nil || string(key) != "k17" || hsm.wasQueried(22) {
+		t.Fatalf("got %q (%v), queried %v, want k17 from 17 only", key, err, hsm.queried)
+	}
+
+	// the primary is slow : the second replica is queried after the hedge delay
+	hsm = &fakeHSM{keys: map[int]string{17: "k17", 22: "k22"}, delay: map[int]time.Duration{17: time.Second}}
+	start := time.Now()
+	key, err = getKeyWithPolicy(context.Background(), POLICY_HEDGED, 20*time.Millisecond, replicas, hsm.getKey)
+	if err != nil || string(key) != "k22" {
+		t.Fatalf("got %q (%v), want k22", key, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("hedged request took %s", elapsed)
+	}
+
+	// the primary fails : the second replica is queried at once
+	hsm = &fakeHSM{keys: map[int]string{22: "k22"}}
+	key, err = getKeyWithPolicy(context.Background(), POLICY_HEDGED, time.Hour, replicas, hsm.getKey)
+	if err != nil || string(key) != "k22" {
+		t.Fatalf("got %q (%v), want k22", key, err)
+	}
+}
+
+func TestPolicyBothAgree(t *testing.T) {
+	replicas := Replicas(KeyHSM{17, 1}, KeyHSM{22, 1})
+	hsm := &fakeHSM{keys: map[int]string{17: "k", 22: "k"}}
+	key, err := getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas, hsm.getKey)
+	if err != nil || string(key) != "k" {
+		t.Fatalf("got %q (%v), want k", key, err)
+	}
+
+	hsm = &fakeHSM{keys: map[int]string{17: "k", 22: "corrupted"}}
+	if _, err := getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas, hsm.getKey); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("got %v, want ErrKeyMismatch", err)
+	}
+
+	hsm = &fakeHSM{keys: map[int]string{17: "k"}}
+	if _, err := getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas, hsm.getKey); !errors.Is(err, ErrHSMUnavailable) {
+		t.Fatalf("got %v, want ErrHSMUnavailable", err)
+	}
+}
+
+// only the two best replicas are compared : a backup isn't awaited, and its failure doesn't matter
+func TestPolicyBothAgreeBackups(t *testing.T) {
+	replicas := []Replica{
+		{KeyHSM: KeyHSM{17, 1}},
+		{KeyHSM: KeyHSM{22, 1}},
+		{KeyHSM: KeyHSM{23, 1}, Priority: 1},
+	}
+	hsm := &fakeHSM{keys: map[int]string{17: "k", 22: "k"}}
+	key, err := getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas, hsm.getKey)
+	if err != nil || string(key) != "k" {
+		t.Fatalf("got %q (%v) with the backup down, want k", key, err)
+	}
+	if hsm.wasQueried(23) {
+		t.Fatalf("backup queried while the two best replicas answered")
+	}
+
+	// a failing replica is replaced by the backup
+	hsm = &fakeHSM{keys: map[int]string{17: "k", 23: "k"}}
+	key, err = getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas, hsm.getKey)
+	if err != nil || string(key) != "k" {
+		t.Fatalf("got %q (%v), want k from 17 and 23", key, err)
+	}
+	hsm = &fakeHSM{keys: map[int]string{17: "k", 23: "corrupted"}}
+	if _, err := getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas, hsm.getKey); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("got %v, want ErrKeyMismatch", err)
+	}
+
+	// a single replica is enough when there is no other
+	hsm = &fakeHSM{keys: map[int]string{17: "k"}}
+	key, err = getKeyWithPolicy(context.Background(), POLICY_BOTH_AGREE, 0, replicas[:1], hsm.getKey)
+	if err != nil || string(key) != "k" {
+		t.Fatalf("got %q (%v) with a single replica, want k", key, err)
+	}
+}
+
+func TestOrderReplicas(t *testing.T) {
+	replicas := []Replica{
+		{KeyHSM: KeyHSM{23, 1}, Priority: 1},
+		{KeyHSM: KeyHSM{17, 1}, Weight: 1},
+		{KeyHSM: KeyHSM{22, 1}, Weight: 9},
+	}
+	first := map[int]int{}
+	for range 2000 {
+		groups := orderReplicas(replicas)
+		if len(groups) != 2 || len(groups[0]) != 2 || groups[1][0].Hsm_number != 23 {
+			t.Fatalf("replicas not grouped by priority: %v", groups)
+		}
+		first[groups[0][0].Hsm_number]++
+	}
+	// 22 comes first with a probability of 9/10
+	if first[22] < 1600 || first[22] > 1980 {
+		t.Fatalf("22 came first %d times out of 2000, expected about 1800", first[22])
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{POLICY_FIRST_SUCCESS, POLICY_HEDGED, POLICY_BOTH_AGREE} {
+		parsed, err := ParsePolicy(p.String())
+		if err != nil || parsed != p {
+			t.Errorf("ParsePolicy(%q) = %v, %v", p.String(), parsed, err)
+		}
+	}
+	if _, err := ParsePolicy("random"); err == nil {
+		t.Errorf("unknown policy accepted")
+	}
+}
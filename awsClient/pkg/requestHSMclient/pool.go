@@ -0,0 +1,478 @@
+package requestHSMclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	HSMClient keeps persistent connexions to the HSM clients, instead of opening
+	a new TCP connexion for every key request like GetKeyFromHSM does.
+
+	The connexions use the framed protocol (cf protocol.go) : as every answer carries
+	the id of its request, several requests can be in flight on the same connexion
+	(pipelining) and the answers are dispatched by a reader goroutine.
+	If an HSM client only speaks the legacy format, HSMClient falls back to
+	one connexion per request.
+
+	Idle connexions are checked periodically with a HELLO frame and closed
+	if the HSM client doesn't answer. The connexions are checked in parallel,
+	and a check times out well before the next one, so that a hung HSM client doesn't delay the others.
+
+	If a TLS configuration is given, every connexion (pooled or legacy) is made with TLS.
+*/
+
+const (
+	DEFAULT_MAX_CONNS_PER_ADDR   = 4
+	DEFAULT_MAX_PENDING_PER_CONN = 64 // a new connexion is opened above this number of requests in flight
+	DEFAULT_HEALTH_CHECK_PERIOD  = 15 * time.Second
+	HEALTH_CHECK_TIMEOUT_DIVISOR = 4               // a health check times out after HealthCheckPeriod / HEALTH_CHECK_TIMEOUT_DIVISOR
+	DEFAULT_WRITE_TIMEOUT        = 5 * time.Second // timeout of a write on a pooled connexion, when the context has no deadline
+)
+
+var ErrClientClosed = errors.New("HSM client closed")
+
+// returned by the pool when the HSM client doesn't speak the framed protocol
+var errLegacyProtocol = errors.New("HSM client only supports the legacy protocol")
+
+// options of an HSMClient, zero values are replaced by the defaults above
+type HSMClientOptions struct {
+	MaxConnsPerAddr   int
+	MaxPendingPerConn int
+	HealthCheckPeriod time.Duration
+	TLSConfig         *tls.Config   // connexions in plain TCP if nil (cf LoadTLSConfig)
+	Policy            Policy        // policy of GetKey (POLICY_FIRST_SUCCESS by default, cf policy.go)
+	HedgeDelay        time.Duration // delay before querying the next replica with POLICY_HEDGED (DEFAULT_HEDGE_DELAY if 0)
+	MaxRetries        int           // retries on a replica after a failure of the HSM client (cf failover.go), negative : no retry
+	RetryBackoff      time.Duration // delay before the first retry, doubled for each retry
+	AttemptTimeout    time.Duration // timeout of each attempt on a replica, so that a hung HSM client leaves time to retry
+	BreakerThreshold  int           // consecutive failures opening the circuit breaker of an address
+	BreakerCooldown   time.Duration // time during which an address with an open circuit is skipped
+}
+
+// client for the HSM clients, holding a pool of persistent connexions per address.
+// an HSMClient is safe for concurrent use.
+type HSMClient struct {
+	options  HSMClientOptions
+	failover *failover // retries and health of the addresses
+
+	mu     sync.Mutex
+	pools  map[string]*connPool
+	closed bool
+
+	stopHealthCheck chan struct{}
+	healthCheckDone chan struct{}
+}
+
+var (
+	defaultHSMClient     *HSMClient
+	defaultHSMClientOnce sync.Once
+)
+
+// HSMClient used when none is given explicitely.
+// it is created by the first call, so that importing the package doesn't start its health checks
+func DefaultHSMClient() *HSMClient {
+	defaultHSMClientOnce.Do(func() {
+		defaultHSMClient = NewHSMClient(HSMClientOptions{})
+	})
+	return defaultHSMClient
+}
+
+// creates an HSMClient. connexions are only opened by the first requests.
+func NewHSMClient(options HSMClientOptions) *HSMClient {
+	if options.MaxConnsPerAddr <= 0 {
+		options.MaxConnsPerAddr = DEFAULT_MAX_CONNS_PER_ADDR
+	}
+	if options.MaxPendingPerConn <= 0 {
+		options.MaxPendingPerConn = DEFAULT_MAX_PENDING_PER_CONN
+	}
+	if options.HealthCheckPeriod <= 0 {
+		options.HealthCheckPeriod = DEFAULT_HEALTH_CHECK_PERIOD
+	}
+	c := &HSMClient{
+		options:         options,
+		failover:        newFailover(options),
+		pools:           map[string]*connPool{},
+		stopHealthCheck: make(chan struct{}),
+		healthCheckDone: make(chan struct{}),
+	}
+	go c.healthCheckLoop()
+	return c
+}
+
+// closes every connexion of the client. pending requests fail with ErrClientClosed.
+func (c *HSMClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	pools := c.pools
+	c.pools = map[string]*connPool{}
+	c.mu.Unlock()
+
+	close(c.stopHealthCheck)
+	<-c.healthCheckDone
+	for _, pool := range pools {
+		pool.closeAll(ErrClientClosed)
+	}
+	return nil
+}
+
+// same as GetKeyFromHSMContext, but using the pooled connexions
+func (c *HSMClient) GetKeyFromHSM(ctx context.Context, hsm_client_addr string, keyHSM KeyHSM, action string, keyForHSM []byte) ([]byte, error) {
+	hsmrequest, ok := actionMap[action]
+	if !ok {
+		return []byte{}, fmt.Errorf("%w: unsupported request action %s", ErrBadRequest, action)
+	}
+
+	conn, err := c.conn(ctx, hsm_client_addr)
+	if errors.Is(err, errLegacyProtocol) {
+		// one connexion per request with the legacy format
+		res := getKeyFromHSM(ctx, c.dial, hsm_client_addr, keyHSM, action, keyForHSM)
+		return res.key, res.err
+	}
+	if err != nil {
+		return []byte{}, fmt.Errorf("error sending request to HSM client: %w", err)
+	}
+
+	payload := append([]byte{byte(keyHSM.Hsm_number), byte(keyHSM.Key_index)}, keyForHSM...)
+	answer, err := conn.roundTrip(ctx, hsmrequest.Code, payload)
+	if err != nil {
+		return []byte{}, fmt.Errorf("error sending request to HSM client: error with key request to HSM %d at index %d: %w", keyHSM.Hsm_number, keyHSM.Key_index, err)
+	}
+	if answer.Code != GET_KEY_SUCCESS_CODE {
+		return []byte{}, fmt.Errorf("error sending request to HSM client: %w", StatusError(answer.Code, keyHSM))
+	}
+	if len(answer.Payload) != hsmrequest.Size-1 {
+		return []byte{}, fmt.Errorf("error sending request to HSM client: HSM %d returned %d bytes instead of %d", keyHSM.Hsm_number, len(answer.Payload), hsmrequest.Size-1)
+	}
+	return answer.Payload, nil
+}
+
+// same as GetKeyContext, but using the pooled connexions, the policy
+// and the failover options of the client (cf policy.go and failover.go)
+func (c *HSMClient) GetKey(ctx context.Context, hsm_client_addr string, replicas []Replica, action string, keyForHSM []byte) ([]byte, error) {
+	return getKeyWithPolicy(ctx, c.options.Policy, c.options.HedgeDelay, replicas, func(ctx context.Context, replica Replica) resGetKey {
+		return c.failover.getKey(ctx, hsm_client_addr, replica, func(ctx context.Context, hsm_client_addr string, keyHSM KeyHSM) ([]byte, error) {
+			return c.GetKeyFromHSM(ctx, hsm_client_addr, keyHSM, action, keyForHSM)
+		})
+	})
+}
+
+// opens a connexion to the HSM client, with TLS if the client has a TLS configuration
+func (c *HSMClient) dial(ctx context.Context, hsm_client_addr string) (net.Conn, error) {
+	if c.options.TLSConfig != nil {
+		return ConnectHSMClientTLS(ctx, hsm_client_addr, c.options.TLSConfig)
+	}
+	return ConnectHSMClientContext(ctx, hsm_client_addr)
+}
+
+// returns a connexion of the pool of the address, opening one if needed
+func (c *HSMClient) conn(ctx context.Context, hsm_client_addr string) (*muxConn, error) {
+	if protocolFor(hsm_client_addr) == PROTOCOL_LEGACY {
+		return nil, errLegacyProtocol
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	pool, ok := c.pools[hsm_client_addr]
+	if !ok {
+		pool = &connPool{addr: hsm_client_addr, dialed: make(chan struct{})}
+		c.pools[hsm_client_addr] = pool
+	}
+	c.mu.Unlock()
+	return pool.get(ctx, c.options, c.dial)
+}
+
+// checks the idle connexions every HealthCheckPeriod until the client is closed
+func (c *HSMClient) healthCheckLoop() {
+	defer close(c.healthCheckDone)
+	ticker := time.NewTicker(c.options.HealthCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopHealthCheck:
+			return
+		case <-ticker.C:
+		}
+		c.healthCheck(c.options.HealthCheckPeriod / HEALTH_CHECK_TIMEOUT_DIVISOR)
+	}
+}
+
+// checks the idle connexions of every address in parallel, and waits for the checks
+func (c *HSMClient) healthCheck(timeout time.Duration) {
+	c.mu.Lock()
+	pools := make([]*connPool, 0, len(c.pools))
+	for _, pool := range c.pools {
+		pools = append(pools, pool)
+	}
+	c.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.healthCheck(timeout)
+		}()
+	}
+	wg.Wait()
+}
+
+// persistent connexions to one HSM client address
+type connPool struct {
+	addr string
+
+	mu      sync.Mutex
+	conns   []*muxConn
+	dialing int           // connexions being opened
+	dialed  chan struct{} // closed each time a connexion has been opened (or failed to)
+}
+
+// returns the least loaded live connexion, or a new one if they are all busy
+func (p *connPool) get(ctx context.Context, options HSMClientOptions, dial dialFunc) (*muxConn, error) {
+	for {
+		p.mu.Lock()
+		var best *muxConn
+		live := p.conns[:0]
+		for _, conn := range p.conns {
+			if conn.isClosed() {
+				continue
+			}
+			live = append(live, conn)
+			if best == nil || conn.pending() < best.pending() {
+				best = conn
+			}
+		}
+		p.conns = live
+		canDial := len(p.conns)+p.dialing < options.MaxConnsPerAddr
+		if best != nil && (best.pending() < options.MaxPendingPerConn || !canDial) {
+			p.mu.Unlock()
+			return best, nil
+		}
+		if best == nil && !canDial {
+			// every connexion is being opened : wait for one of them
+			dialed := p.dialed
+			p.mu.Unlock()
+			select {
+			case <-dialed:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		p.dialing++
+		p.mu.Unlock()
+
+		conn, err := dialMuxConn(ctx, dial, p.addr)
+
+		p.mu.Lock()
+		p.dialing--
+		close(p.dialed)
+		p.dialed = make(chan struct{})
+		if err == nil {
+			p.conns = append(p.conns, conn)
+		}
+		p.mu.Unlock()
+		if err != nil && best != nil && !best.isClosed() {
+			// the extra connexion couldn't be opened : the busy one still works
+			return best, nil
+		}
+		return conn, err
+	}
+}
+
+// pings in parallel the connexions without request in flight, and closes the ones that don't answer
+func (p *connPool) healthCheck(timeout time.Duration) {
+	p.mu.Lock()
+	conns := append([]*muxConn{}, p.conns...)
+	p.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		if conn.isClosed() || conn.pending() > 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			answer, err := conn.roundTrip(ctx, HELLO_CODE, nil)
+			cancel()
+			if err == nil && answer.Code != HELLO_CODE {
+				err = fmt.Errorf("unexpected answer to health check (code %d)", answer.Code)
+			}
+			if err != nil {
+				conn.close(fmt.Errorf("%w: health check of HSM client %s failed: %w", ErrHSMUnavailable, p.addr, err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *connPool) closeAll(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.close(err)
+	}
+	p.conns = nil
+}
+
+// a framed connexion shared by several requests
+type muxConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	inflight  map[uint32]chan Frame
+	closedErr error         // set once the connexion is unusable
+	closed    chan struct{} // closed at the same time
+}
+
+// opens a connexion and negotiates the framed protocol on it
+func dialMuxConn(ctx context.Context, dial dialFunc, hsm_client_addr string) (*muxConn, error) {
+	conn, err := dial(ctx, hsm_client_addr)
+	if err != nil {
+		return nil, err
+	}
+	protocol := protocolFor(hsm_client_addr)
+	if protocol == PROTOCOL_AUTO {
+		protocol, err = negotiateProtocol(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		rememberProtocol(hsm_client_addr, protocol)
+	}
+	if protocol == PROTOCOL_LEGACY {
+		conn.Close()
+		return nil, errLegacyProtocol
+	}
+
+	m := &muxConn{conn: conn, inflight: map[uint32]chan Frame{}, closed: make(chan struct{})}
+	go m.readLoop()
+	return m, nil
+}
+
+// dispatches the answers to the waiting requests until the connexion fails
+func (m *muxConn) readLoop() {
+	for {
+		frame, err := ReadFrame(m.conn)
+		if err != nil {
+			m.close(fmt.Errorf("%w: connexion to HSM client lost: %w", ErrHSMUnavailable, err))
+			return
+		}
+		m.mu.Lock()
+		waiting, ok := m.inflight[frame.RequestID]
+		delete(m.inflight, frame.RequestID)
+		m.mu.Unlock()
+		// answers to cancelled requests are dropped
+		if ok {
+			waiting <- frame
+		}
+	}
+}
+
+// sends a request and waits for its answer, or for the end of the context
+func (m *muxConn) roundTrip(ctx context.Context, code byte, payload []byte) (Frame, error) {
+	id := nextRequestID()
+	answer := make(chan Frame, 1)
+	m.mu.Lock()
+	if m.closedErr != nil {
+		m.mu.Unlock()
+		return Frame{}, m.closedErr
+	}
+	m.inflight[id] = answer
+	m.mu.Unlock()
+
+	forget := func() {
+		m.mu.Lock()
+		delete(m.inflight, id)
+		m.mu.Unlock()
+	}
+
+	m.writeMu.Lock()
+	err := m.write(ctx, Frame{Version: FRAME_VERSION, RequestID: id, Code: code, Payload: payload})
+	m.writeMu.Unlock()
+	if err != nil {
+		forget()
+		// a partial write leaves the stream in an unknown state
+		m.close(fmt.Errorf("%w: error writing to HSM client: %w", ErrHSMUnavailable, err))
+		if ctx.Err() != nil {
+			return Frame{}, ctx.Err()
+		}
+		return Frame{}, err
+	}
+
+	select {
+	case frame := <-answer:
+		return frame, nil
+	case <-ctx.Done():
+		forget()
+		return Frame{}, ctx.Err()
+	case <-m.closed:
+		forget()
+		return Frame{}, m.err()
+	}
+}
+
+// writes a frame before the deadline of the context (or DEFAULT_WRITE_TIMEOUT),
+// and interrupts the write if the context is cancelled. the caller holds writeMu.
+func (m *muxConn) write(ctx context.Context, frame Frame) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DEFAULT_WRITE_TIMEOUT)
+	}
+	m.conn.SetWriteDeadline(deadline)
+	// on cancellation, a deadline in the past unblocks the write
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		m.conn.SetWriteDeadline(time.Now())
+		close(interrupted)
+	})
+	err := WriteFrame(m.conn, frame)
+	if !stop() {
+		// the deadline must not be changed during the write of the next request
+		<-interrupted
+	}
+	return err
+}
+
+// number of requests in flight on the connexion
+func (m *muxConn) pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inflight)
+}
+
+func (m *muxConn) isClosed() bool {
+	return m.err() != nil
+}
+
+func (m *muxConn) err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closedErr
+}
+
+// marks the connexion as unusable and closes it
+func (m *muxConn) close(err error) {
+	m.mu.Lock()
+	if m.closedErr != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.closedErr = err
+	close(m.closed)
+	m.mu.Unlock()
+	m.conn.Close()
+}
@@ -0,0 +1,175 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+// many concurrent requests are pipelined on the connexions of the pool
+func TestHSMClientPipelining(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{MaxLatency: 5 * time.Millisecond})
+	c := newTestClient(t, HSMClientOptions{MaxConnsPerAddr: 2})
+	replicas := Replicas(KeyHSM{17, 1}, KeyHSM{22, 1})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k := testDataKey(byte(i))
+			ck, err := c.GetKey(context.Background(), addr, replicas, "CreateCk", k)
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, err := c.GetKey(context.Background(), addr, replicas, "GetKFromCK", ck)
+			if err == nil && !bytes.Equal(got, k) {
+				err = errors.New("wrong key")
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	c.mu.Lock()
+	conns := len(c.pools[addr].conns)
+	c.mu.Unlock()
+	if conns > 2 {
+		t.Fatalf("%d connexions opened, max 2", conns)
+	}
+}
+
+// when the extra connexion can't be opened, the busy one is used
+func TestPoolDialFailureFallsBack(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{})
+	server.SetFault(17, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_HANG})
+	options := HSMClientOptions{MaxConnsPerAddr: 2, MaxPendingPerConn: 1}
+	pool := &connPool{addr: addr, dialed: make(chan struct{})}
+	ctx := context.Background()
+
+	busy, err := pool.get(ctx, options, ConnectHSMClientContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.close(ErrClientClosed)
+	// a request that never gets an answer keeps the connexion busy
+	hung, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go busy.roundTrip(hung, 3, append([]byte{17, 1}, testDataKey(1)...))
+	for busy.pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	failingDial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, ErrHSMUnavailable
+	}
+	conn, err := pool.get(ctx, options, failingDial)
+	if err != nil || conn != busy {
+		t.Fatalf("got %p (%v), want the busy connexion %p", conn, err, busy)
+	}
+	answer, err := conn.roundTrip(ctx, 3, append([]byte{22, 1}, testDataKey(2)...))
+	if err != nil || answer.Code != GET_KEY_SUCCESS_CODE {
+		t.Fatalf("request on the busy connexion: %+v (%v)", answer, err)
+	}
+
+	// without a live connexion, the dial error is returned
+	busy.close(ErrClientClosed)
+	if _, err := pool.get(ctx, options, failingDial); !errors.Is(err, ErrHSMUnavailable) {
+		t.Fatalf("got %v, want the dial error", err)
+	}
+}
+
+// once the client is closed, the requests fail with ErrClientClosed
+func TestHSMClientClose(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	c := NewHSMClient(HSMClientOptions{})
+	if _, err := c.GetKey(context.Background(), addr, Replicas(KeyHSM{17, 1}), "CreateCk", testDataKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	_, err := c.GetKeyFromHSM(context.Background(), addr, KeyHSM{17, 1}, "CreateCk", testDataKey(1))
+	if !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("got %v after Close, want ErrClientClosed", err)
+	}
+}
+
+// hung HSM clients are checked in parallel, and don't keep the others from being checked
+func TestHealthCheckHungHSMClients(t *testing.T) {
+	setTestProtocol(t, PROTOCOL_AUTO)
+	_, healthy := startMock(t, mockHSMclient.Options{})
+	// answers the negotiation, then never again
+	hang := func(conn net.Conn) {
+		hello, err := ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		WriteFrame(conn, Frame{Version: FRAME_VERSION, RequestID: hello.RequestID, Code: HELLO_CODE})
+		io.Copy(io.Discard, conn)
+	}
+	c := newTestClient(t, HSMClientOptions{})
+	ctx := context.Background()
+	var hung []*muxConn
+	for range 4 {
+		conn, err := c.conn(ctx, startRawServer(t, hang))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hung = append(hung, conn)
+	}
+	alive, err := c.conn(ctx, healthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	c.healthCheck(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("health check took %s, the hung HSM clients were checked one after the other", elapsed)
+	}
+	for _, conn := range hung {
+		if !conn.isClosed() {
+			t.Error("connexion to a hung HSM client still open")
+		}
+	}
+	if alive.isClosed() {
+		t.Fatalf("healthy connexion closed: %v", alive.err())
+	}
+}
+
+// a write blocked on a connexion is interrupted by the cancellation of a context without deadline
+func TestRoundTripWriteCancelled(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	// nobody reads on the other side of the pipe : the write blocks
+	m := &muxConn{conn: client, inflight: map[uint32]chan Frame{}, closed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.roundTrip(ctx, 3, append([]byte{17, 1}, testDataKey(1)...))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(DEFAULT_WRITE_TIMEOUT / 2):
+		t.Fatal("write not interrupted by the cancellation")
+	}
+}
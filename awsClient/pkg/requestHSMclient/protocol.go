@@ -0,0 +1,253 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+	Framed protocol between the AWS client and the HSM client.
+
+	Every message (request or response) is a frame :
+	  magic (2 bytes "HK") | version (1 byte) | request id (4 bytes) | length (4 bytes) | code (1 byte) | payload (length bytes)
+	all integers being big endian.
+	In a request, the code is the action (cf actionMap) and the payload is [hsm number, key index, data...].
+	In a response, the code is the status of the request (GET_KEY_SUCCESS_CODE on success)
+	and the payload the answer of the HSM (without the status byte of the legacy format).
+
+	The legacy format ([action, hsm, index, payload...] answered by a fixed-size buffer) is still supported :
+	the protocol is negotiated with a HELLO frame the first time we talk to an HSM client address,
+	and we fall back to the legacy format if the HSM client answers something that isn't a frame,
+	or closes the connexion without answering (what the legacy HSM clients do with an unknown request).
+	An HSM client that doesn't answer at all is not assumed to be legacy (it may just be slow) :
+	the request fails and the negotiation is tried again by the next one.
+	A legacy HSM client that keeps the connexion open without answering the HELLO frame
+	has to be set with PROTOCOL_LEGACY.
+*/
+
+const (
+	FRAME_MAGIC_0     byte = 'H'
+	FRAME_MAGIC_1     byte = 'K'
+	FRAME_VERSION     byte = 1         // highest protocol version supported by this client
+	FRAME_HEADER_SIZE      = 12        // magic + version + request id + length + code
+	MAX_FRAME_PAYLOAD      = 64 * 1024 // larger frames are rejected
+	HELLO_CODE        byte = 0xF0      // code of the frame used to negotiate the protocol
+)
+
+// timeout of the HELLO exchange: a legacy HSM client may never answer to it
+const NEGOTIATION_TIMEOUT = 2 * time.Second
+
+var ErrBadMagic = errors.New("not a framed HSM message")
+
+// wire format used to talk to the HSM client
+type Protocol int
+
+const (
+	PROTOCOL_AUTO   Protocol = iota // negotiate with the HSM client (framed if supported, else legacy)
+	PROTOCOL_LEGACY                 // always use the legacy format
+	PROTOCOL_FRAMED                 // always use the framed format
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case PROTOCOL_AUTO:
+		return "auto"
+	case PROTOCOL_LEGACY:
+		return "legacy"
+	case PROTOCOL_FRAMED:
+		return "framed"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// parses a protocol name as given on the command line ("auto", "legacy" or "framed")
+func ParseProtocol(name string) (Protocol, error) {
+	for _, p := range []Protocol{PROTOCOL_AUTO, PROTOCOL_LEGACY, PROTOCOL_FRAMED} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return PROTOCOL_AUTO, fmt.Errorf("unknown HSM protocol %q (expected auto, legacy or framed)", name)
+}
+
+// a message of the framed protocol
+type Frame struct {
+	Version   byte
+	RequestID uint32
+	Code      byte // action of a request, or status of a response
+	Payload   []byte
+}
+
+// writes a frame in a single Write call
+func WriteFrame(w io.Writer, frame Frame) error {
+	if len(frame.Payload) > MAX_FRAME_PAYLOAD {
+		return fmt.Errorf("frame payload too large (%d bytes)", len(frame.Payload))
+	}
+	buf := make([]byte, FRAME_HEADER_SIZE+len(frame.Payload))
+	buf[0] = FRAME_MAGIC_0
+	buf[1] = FRAME_MAGIC_1
+	buf[2] = frame.Version
+	binary.BigEndian.PutUint32(buf[3:7], frame.RequestID)
+	binary.BigEndian.PutUint32(buf[7:11], uint32(len(frame.Payload)))
+	buf[11] = frame.Code
+	copy(buf[FRAME_HEADER_SIZE:], frame.Payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// reads a whole frame, however the bytes are split by the transport.
+// returns ErrBadMagic if the peer doesn't speak the framed protocol.
+func ReadFrame(r io.Reader) (Frame, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Frame{}, err
+	}
+	if header[0] != FRAME_MAGIC_0 || header[1] != FRAME_MAGIC_1 {
+		return Frame{}, ErrBadMagic
+	}
+	length := binary.BigEndian.Uint32(header[7:11])
+	if length > MAX_FRAME_PAYLOAD {
+		return Frame{}, fmt.Errorf("frame payload too large (%d bytes)", length)
+	}
+	frame := Frame{
+		Version:   header[2],
+		RequestID: binary.BigEndian.Uint32(header[3:7]),
+		Code:      header[11],
+		Payload:   make([]byte, length),
+	}
+	_, err = io.ReadFull(r, frame.Payload)
+	if err != nil {
+		return Frame{}, fmt.Errorf("truncated frame: %w", err)
+	}
+	return frame, nil
+}
+
+// request ids, unique for the process
+var lastRequestID atomic.Uint32
+
+func nextRequestID() uint32 {
+	return lastRequestID.Add(1)
+}
+
+// protocol chosen by the user, and protocol negotiated with each HSM client address
+var negotiation = struct {
+	sync.Mutex
+	setting Protocol
+	byAddr  map[string]Protocol
+}{setting: PROTOCOL_AUTO, byAddr: map[string]Protocol{}}
+
+// sets the protocol used for the next requests (PROTOCOL_AUTO by default)
+func SetProtocol(p Protocol) {
+	negotiation.Lock()
+	defer negotiation.Unlock()
+	negotiation.setting = p
+	negotiation.byAddr = map[string]Protocol{}
+}
+
+// returns the protocol to use with an HSM client, PROTOCOL_AUTO meaning it isn't known yet
+func protocolFor(hsm_client_addr string) Protocol {
+	negotiation.Lock()
+	defer negotiation.Unlock()
+	if negotiation.setting != PROTOCOL_AUTO {
+		return negotiation.setting
+	}
+	return negotiation.byAddr[hsm_client_addr]
+}
+
+func rememberProtocol(hsm_client_addr string, p Protocol) {
+	negotiation.Lock()
+	defer negotiation.Unlock()
+	negotiation.byAddr[hsm_client_addr] = p
+}
+
+// sends a HELLO frame on a fresh connexion and waits for the answer.
+// returns PROTOCOL_FRAMED if the HSM client answered with a frame, PROTOCOL_LEGACY if it answered
+// something that isn't a frame or closed the connexion without answering, and an error otherwise
+// (no answer in time, write error...), in which case nothing is learnt : only an answer is remembered by the caller.
+// in the legacy case the connexion is unusable and must be closed by the caller.
+func negotiateProtocol(ctx context.Context, conn net.Conn) (Protocol, error) {
+	deadline := time.Now().Add(NEGOTIATION_TIMEOUT)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	id := nextRequestID()
+	err := WriteFrame(conn, Frame{Version: FRAME_VERSION, RequestID: id, Code: HELLO_CODE})
+	if err == nil {
+		var protocol Protocol
+		protocol, err = readHelloAnswer(conn, id)
+		if err == nil {
+			return protocol, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return PROTOCOL_AUTO, fmt.Errorf("error negotiating protocol with HSM client: %w", ctx.Err())
+	}
+	return PROTOCOL_AUTO, fmt.Errorf("%w: error negotiating protocol with HSM client: %w", ErrHSMUnavailable, err)
+}
+
+// reads the answer to the HELLO frame of the given request id.
+// a legacy HSM client closes the connexion on a request it doesn't understand,
+// or answers it with a status byte, which isn't the start of a frame.
+func readHelloAnswer(r io.Reader, id uint32) (Protocol, error) {
+	first := make([]byte, 1)
+	_, err := io.ReadFull(r, first)
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+		return PROTOCOL_LEGACY, nil
+	}
+	if err != nil {
+		return PROTOCOL_AUTO, err
+	}
+	if first[0] != FRAME_MAGIC_0 {
+		return PROTOCOL_LEGACY, nil
+	}
+	answer, err := ReadFrame(io.MultiReader(bytes.NewReader(first), r))
+	if errors.Is(err, ErrBadMagic) {
+		return PROTOCOL_LEGACY, nil
+	}
+	if err != nil {
+		return PROTOCOL_AUTO, err
+	}
+	if answer.Code != HELLO_CODE || answer.RequestID != id || answer.Version == 0 {
+		return PROTOCOL_LEGACY, nil
+	}
+	return PROTOCOL_FRAMED, nil
+}
+
+// send a key request with the framed protocol on the open connexion
+// and returns the payload of the answer (the key, without status byte).
+func sendFramedKeyRequest(conn net.Conn, keyHSM KeyHSM, hsmrequest HSMRequestsize, keyForHSM []byte) ([]byte, error) {
+	id := nextRequestID()
+	payload := append([]byte{byte(keyHSM.Hsm_number), byte(keyHSM.Key_index)}, keyForHSM...)
+	err := WriteFrame(conn, Frame{Version: FRAME_VERSION, RequestID: id, Code: hsmrequest.Code, Payload: payload})
+	if err != nil {
+		return []byte{}, fmt.Errorf("error sending key request to HSM %d at index %d: %w", keyHSM.Hsm_number, keyHSM.Key_index, err)
+	}
+
+	answer, err := ReadFrame(conn)
+	if err != nil {
+		return []byte{}, fmt.Errorf("error reading key request (index %d) answer from HSM %d: %w", keyHSM.Key_index, keyHSM.Hsm_number, err)
+	}
+	if answer.RequestID != id {
+		return []byte{}, fmt.Errorf("HSM %d answered to request %d instead of %d", keyHSM.Hsm_number, answer.RequestID, id)
+	}
+	if answer.Code != GET_KEY_SUCCESS_CODE {
+		return []byte{}, StatusError(answer.Code, keyHSM)
+	}
+	if len(answer.Payload) != hsmrequest.Size-1 {
+		return []byte{}, fmt.Errorf("HSM %d returned %d bytes instead of %d", keyHSM.Hsm_number, len(answer.Payload), hsmrequest.Size-1)
+	}
+	return answer.Payload, nil
+}
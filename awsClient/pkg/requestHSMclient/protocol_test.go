@@ -0,0 +1,202 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	sent := Frame{Version: FRAME_VERSION, RequestID: 42, Code: 4, Payload: []byte{17, 1, 'c', 'k'}}
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, sent); err != nil {
+		t.Fatal(err)
+	}
+	// the frame must be read whole, even one byte at a time
+	received, err := ReadFrame(iotest.OneByteReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Version != sent.Version || received.RequestID != sent.RequestID || received.Code != sent.Code || !bytes.Equal(received.Payload, sent.Payload) {
+		t.Fatalf("received %+v, sent %+v", received, sent)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	var frame bytes.Buffer
+	WriteFrame(&frame, Frame{Version: FRAME_VERSION, RequestID: 1, Payload: []byte("payload")})
+	encoded := frame.Bytes()
+
+	tooLarge := append([]byte{}, encoded[:FRAME_HEADER_SIZE]...)
+	binary.BigEndian.PutUint32(tooLarge[7:11], MAX_FRAME_PAYLOAD+1)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"bad magic", append([]byte{0, 'K'}, encoded[2:]...), ErrBadMagic},
+		{"truncated header", encoded[:5], io.ErrUnexpectedEOF},
+		{"truncated payload", encoded[:len(encoded)-1], io.ErrUnexpectedEOF},
+		{"empty", nil, io.EOF},
+	}
+	for _, test := range tests {
+		_, err := ReadFrame(bytes.NewReader(test.input))
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+	if _, err := ReadFrame(bytes.NewReader(tooLarge)); err == nil {
+		t.Errorf("a frame larger than MAX_FRAME_PAYLOAD was accepted")
+	}
+	if err := WriteFrame(io.Discard, Frame{Payload: make([]byte, MAX_FRAME_PAYLOAD+1)}); err == nil {
+		t.Errorf("a frame larger than MAX_FRAME_PAYLOAD was written")
+	}
+}
+
+// the legacy answer may be split over several reads
+func TestSendKeyRequestShortReads(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	key := testDataKey(7)
+	go func() {
+		defer server.Close()
+		request := make([]byte, 3)
+		io.ReadFull(server, request)
+		for _, b := range append([]byte{GET_KEY_SUCCESS_CODE}, key...) {
+			server.Write([]byte{b})
+		}
+	}()
+	got, err := SendKeyRequest(client, KeyHSM{17, 1}, []byte{0, 17, 1}, 1+len(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatalf("got key %x, want %x", got, key)
+	}
+}
+
+// an error status is decoded at once, even if the answer is shorter than a key
+// and the HSM client keeps the connexion open
+func TestSendKeyRequestStatus(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer server.Close()
+		io.ReadFull(server, make([]byte, 3))
+		server.Write([]byte{STATUS_KEY_NOT_FOUND})
+		<-done
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := SendKeyRequestContext(ctx, client, KeyHSM{17, 1}, []byte{0, 17, 1}, 17)
+	var hsmErr *HSMError
+	if !errors.As(err, &hsmErr) || !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v, want an HSMError wrapping ErrKeyNotFound", err)
+	}
+}
+
+// starts a TCP server answering every connexion with handle
+func startRawServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	_, framed := startMock(t, mockHSMclient.Options{})
+	// a legacy HSM client answers an unknown request with a status byte
+	legacy := startRawServer(t, func(conn net.Conn) {
+		io.ReadFull(conn, make([]byte, 3))
+		conn.Write([]byte{STATUS_BAD_REQUEST})
+	})
+	// or closes the connexion without answering, like the original HSM client
+	_, closing := startMock(t, mockHSMclient.Options{Legacy: true})
+	// a slow HSM client doesn't answer in time
+	silent := startRawServer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	for _, test := range []struct {
+		addr string
+		want Protocol
+	}{{framed, PROTOCOL_FRAMED}, {legacy, PROTOCOL_LEGACY}, {closing, PROTOCOL_LEGACY}} {
+		conn, err := ConnectHSMClient(test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := negotiateProtocol(context.Background(), conn)
+		conn.Close()
+		if err != nil || got != test.want {
+			t.Errorf("negotiation with %s: got %s (%v), want %s", test.addr, got, err, test.want)
+		}
+	}
+
+	// a timeout is an error, and isn't remembered as a legacy HSM client
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res := GetKeyFromHSMContext(ctx, silent, KeyHSM{17, 1}, "CreateCk", testDataKey(1))
+	if res.err == nil {
+		t.Fatalf("request to a silent HSM client succeeded")
+	}
+	if p := protocolFor(silent); p != PROTOCOL_AUTO {
+		t.Fatalf("protocol %s remembered after a timeout", p)
+	}
+}
+
+// with the default protocol, an HSM client that closes the connexion on the HELLO frame
+// is served with the legacy format, without waiting for a timeout
+func TestNegotiateWithClosingHSMClient(t *testing.T) {
+	setTestProtocol(t, PROTOCOL_AUTO)
+	_, addr := startMock(t, mockHSMclient.Options{Legacy: true})
+	replicas := Replicas(KeyHSM{17, 1})
+	c := newTestClient(t, HSMClientOptions{MaxRetries: -1})
+	ctx, cancel := context.WithTimeout(context.Background(), NEGOTIATION_TIMEOUT/2)
+	defer cancel()
+
+	for _, getKey := range []func(action string, payload []byte) ([]byte, error){
+		func(action string, payload []byte) ([]byte, error) {
+			return GetKeyContext(ctx, addr, replicas, action, payload)
+		},
+		func(action string, payload []byte) ([]byte, error) {
+			return c.GetKey(ctx, addr, replicas, action, payload)
+		},
+	} {
+		ck, err := getKey("CreateCk", testDataKey(1))
+		if err != nil {
+			t.Fatalf("CreateCk: %v", err)
+		}
+		if got, err := getKey("GetKFromCK", ck); err != nil || !bytes.Equal(got, testDataKey(1)) {
+			t.Fatalf("GetKFromCK: got %x (%v)", got, err)
+		}
+		if p := protocolFor(addr); p != PROTOCOL_LEGACY {
+			t.Fatalf("protocol %s remembered, want legacy", p)
+		}
+	}
+}
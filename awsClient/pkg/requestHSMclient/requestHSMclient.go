@@ -1,25 +1,39 @@
 package requestHSMclient
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"time"
 )
 
 const (
 	GET_KEY_SUCCESS_CODE byte = 0 // code returned by the HSM client if the key request was successfull
 )
 
+// timeout applied to a key request when the context given by the caller has no deadline,
+// so that a hung HSM client can't block a put/get forever
+const DEFAULT_REQUEST_TIMEOUT = 10 * time.Second
+
 type HSMRequestsize struct {
 	Code byte
 	Size int
 }
 
 var actionMap = map[string]HSMRequestsize{
-	"getK":       {0, 17}, // request code for the client HSM (read Key) and size of the expected answer from the HSM client (success byte + 16 key bytes)
-	"CreateCk":   {3, 49}, // request to create a ck from a key
-	"GetKFromCK": {4, 33}, // request to get key from ck
+	"getK":          {0, 17},  // request code for the client HSM (read Key) and size of the expected answer from the HSM client (success byte + 16 key bytes)
+	"CreateCk":      {3, 49},  // request to create a ck from a key
+	"GetKFromCK":    {4, 33},  // request to get key from ck
+	"CreateCkCtx":   {5, 49},  // same as CreateCk, the ck is bound to a context (cf ContextPayload)
+	"GetKFromCKCtx": {6, 33},  // same as GetKFromCK, for a ck bound to a context
+	"EvalTPRF":      {7, 257}, // partial evaluation of the threshold PRF on a blinded input (cf tprf.go)
 }
 
+// maximum size of the context bound to a ck
+const MAX_CONTEXT_SIZE = 4096
+
 // structure to represent a key on a given HSM.
 // at the moment we'll use HSM key17 and key22 (hsm_number: 17 or 22)
 // and there are 32 indexes on each HSM.
@@ -28,13 +42,75 @@ type KeyHSM struct {
 	Key_index  int
 }
 
+// number of key indexes on each HSM
+const KEY_INDEXES_PER_HSM = 32
+
+// checks that the key can be sent in a request :
+// the HSM number and the key index are sent as single bytes, and the index must exist on the HSM
+func (k KeyHSM) Validate() error {
+	if k.Hsm_number < 0 || k.Hsm_number > 255 {
+		return fmt.Errorf("invalid HSM number %d (must fit in a byte)", k.Hsm_number)
+	}
+	if k.Key_index < 0 || k.Key_index >= KEY_INDEXES_PER_HSM {
+		return fmt.Errorf("invalid key index %d on HSM %d (must be between 0 and %d)", k.Key_index, k.Hsm_number, KEY_INDEXES_PER_HSM-1)
+	}
+	return nil
+}
+
+func (k KeyHSM) String() string {
+	return fmt.Sprintf("%d:%d", k.Hsm_number, k.Key_index)
+}
+
+// a replica of the key : its location on an HSM, with the priority and the weight
+// used to choose which HSM are queried first (cf policy.go)
+type Replica struct {
+	KeyHSM
+	Priority  int      // the replicas with the lowest priority are queried first
+	Weight    int      // the replicas of the same priority are ordered at random, in proportion to their weight (1 if 0)
+	Addresses []string // HSM clients through which the HSM is reached, in order of preference (cf failover.go). if empty, the address given to GetKey
+}
+
+// replicas of same priority and weight, at the given locations
+func Replicas(keyHSMs ...KeyHSM) []Replica {
+	replicas := make([]Replica, 0, len(keyHSMs))
+	for _, keyHSM := range keyHSMs {
+		replicas = append(replicas, Replica{KeyHSM: keyHSM})
+	}
+	return replicas
+}
+
+func (r Replica) Validate() error {
+	if err := r.KeyHSM.Validate(); err != nil {
+		return err
+	}
+	if r.Priority < 0 {
+		return fmt.Errorf("invalid priority %d of the key replica on HSM %d (must not be negative)", r.Priority, r.Hsm_number)
+	}
+	if r.Weight < 0 {
+		return fmt.Errorf("invalid weight %d of the key replica on HSM %d (must not be negative)", r.Weight, r.Hsm_number)
+	}
+	for _, addr := range r.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid HSM client address %q of the key replica on HSM %d: %w", addr, r.Hsm_number, err)
+		}
+	}
+	return nil
+}
+
 // connect to HSM client via a TCP socket.
 // you have to give the HSM client address in parameter
 // ex: ConnectHSMClient("localhost:8080")
 func ConnectHSMClient(hsm_client_addr string) (net.Conn, error) {
-	conn, err := net.Dial("tcp", hsm_client_addr)
+	return ConnectHSMClientContext(context.Background(), hsm_client_addr)
+}
+
+// same as ConnectHSMClient, but the dial is aborted
+// if the context is cancelled or its deadline is exceeded.
+func ConnectHSMClientContext(ctx context.Context, hsm_client_addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", hsm_client_addr)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to HSM client %s: %w", hsm_client_addr, err)
+		return nil, fmt.Errorf("%w: error connecting to HSM client %s: %w", ErrHSMUnavailable, hsm_client_addr, err)
 	}
 	return conn, nil
 }
@@ -47,30 +123,82 @@ func MakeKeyRequestMessage(keyHSM KeyHSM, action byte, keyForHSM []byte) []byte
 	return request
 }
 
+// builds the payload of the requests CreateCkCtx and GetKFromCKCtx :
+// the key (or the ck), the size of the context on 2 bytes (big endian), and the context.
+// the HSM authenticates the context with the ck : the key can only be retrieved with the same context.
+func ContextPayload(keyForHSM []byte, context []byte) ([]byte, error) {
+	if len(context) > MAX_CONTEXT_SIZE {
+		return nil, fmt.Errorf("%w: context of %d bytes (max %d)", ErrBadRequest, len(context), MAX_CONTEXT_SIZE)
+	}
+	payload := make([]byte, 0, len(keyForHSM)+2+len(context))
+	payload = append(payload, keyForHSM...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(context)))
+	return append(payload, context...), nil
+}
+
 // send a request on the open connexion with the HSM client
 // to retrieve key at the index given in parameter.
-// returns the key bytes and an error.
+// returns the key bytes and an error (an *HSMError if the HSM client answered with an error status).
 func SendKeyRequest(conn net.Conn, keyHSM KeyHSM, request []byte, size int) ([]byte, error) {
+	return SendKeyRequestContext(context.Background(), conn, keyHSM, request, size)
+}
+
+// same as SendKeyRequest, but the write and the read on the connexion
+// are interrupted when the context is cancelled or its deadline is exceeded.
+func SendKeyRequestContext(ctx context.Context, conn net.Conn, keyHSM KeyHSM, request []byte, size int) ([]byte, error) {
+	return sendWithContext(ctx, conn, keyHSM, func() ([]byte, error) {
+		return sendKeyRequest(conn, keyHSM, request, size)
+	})
+}
+
+// runs a request on the connexion, interrupting it when the context is done
+func sendWithContext(ctx context.Context, conn net.Conn, keyHSM KeyHSM, send func() ([]byte, error)) ([]byte, error) {
+	// the context deadline becomes the connexion deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		err := conn.SetDeadline(deadline)
+		if err != nil {
+			return []byte{}, fmt.Errorf("error setting deadline on HSM client connexion: %w", err)
+		}
+	}
+	// on cancellation, a deadline in the past unblocks the pending write/read
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	key, err := send()
+	if err != nil && ctx.Err() != nil {
+		// report the cancellation rather than the i/o timeout it caused
+		return []byte{}, fmt.Errorf("key request to HSM %d at index %d aborted: %w", keyHSM.Hsm_number, keyHSM.Key_index, ctx.Err())
+	}
+	return key, err
+}
+
+func sendKeyRequest(conn net.Conn, keyHSM KeyHSM, request []byte, size int) ([]byte, error) {
 	// send request to HSM client
 	_, err := conn.Write(request)
 	if err != nil {
 		return []byte{}, fmt.Errorf("error sending key request to HSM %d at index %d: %w", keyHSM.Hsm_number, keyHSM.Key_index, err)
 	}
 
-	// wait for HSM client answer
-	buf := make([]byte, size)
-	_, err = conn.Read(buf)
+	// read the status byte first : an error answer is a single byte,
+	// and the HSM client may keep the connexion open after it
+	status := make([]byte, 1)
+	_, err = io.ReadFull(conn, status)
 	if err != nil {
 		return []byte{}, fmt.Errorf("error reading key request (index %d) answer from HSM %d: %w", keyHSM.Key_index, keyHSM.Hsm_number, err)
 	}
+	if status[0] != GET_KEY_SUCCESS_CODE {
+		return []byte{}, StatusError(status[0], keyHSM)
+	}
 
-	// analyse HSM client answer code
-	if buf[0] != GET_KEY_SUCCESS_CODE {
-		return []byte{}, fmt.Errorf("the HSM client returned that the key request at HSM %d index %d failed", keyHSM.Hsm_number, keyHSM.Key_index)
-	} else {
-		// if the first byte indicates a success, we return the 16 following bytes containing the key
-		return buf[1:], nil
+	// on success, the key follows (it may be split over several reads)
+	key := make([]byte, size-1)
+	_, err = io.ReadFull(conn, key)
+	if err != nil {
+		return []byte{}, fmt.Errorf("error reading key request (index %d) answer from HSM %d: %w", keyHSM.Key_index, keyHSM.Hsm_number, err)
 	}
+	return key, nil
 }
 
 // result type for the function GetKetFromHSM.
@@ -85,63 +213,87 @@ type resGetKey struct {
 // returns the key in string format and an error.
 
 func GetKeyFromHSM(hsm_client_addr string, keyHSM KeyHSM, action string, keyForHSM []byte) resGetKey {
+	return GetKeyFromHSMContext(context.Background(), hsm_client_addr, keyHSM, action, keyForHSM)
+}
+
+// same as GetKeyFromHSM, but the whole request (dial, write and read)
+// honours the cancellation and the deadline of the context.
+func GetKeyFromHSMContext(ctx context.Context, hsm_client_addr string, keyHSM KeyHSM, action string, keyForHSM []byte) resGetKey {
+	return getKeyFromHSM(ctx, ConnectHSMClientContext, hsm_client_addr, keyHSM, action, keyForHSM)
+}
+
+// function opening a connexion to the HSM client (plain TCP or TLS)
+type dialFunc func(ctx context.Context, hsm_client_addr string) (net.Conn, error)
+
+// sends a key request on a new connexion opened with dial
+func getKeyFromHSM(ctx context.Context, dial dialFunc, hsm_client_addr string, keyHSM KeyHSM, action string, keyForHSM []byte) resGetKey {
 	// opens a connexion to the HSM client, that will interact with the HSM
-	conn, err := ConnectHSMClient(hsm_client_addr)
+	conn, err := dial(ctx, hsm_client_addr)
 	if err != nil {
-		return resGetKey{key: []byte{}, err: fmt.Errorf("error sending request to HSM client: %v", err)}
+		return resGetKey{key: []byte{}, err: fmt.Errorf("error sending request to HSM client: %w", err)}
 	}
-	defer conn.Close()
+	defer func() {
+		conn.Close()
+	}()
 	hsmrequest, ok := actionMap[action]
 	if !ok {
-		return resGetKey{key: []byte{}, err: fmt.Errorf("Error: Unsupported request action. : %s", action)}
+		return resGetKey{key: []byte{}, err: fmt.Errorf("%w: unsupported request action %s", ErrBadRequest, action)}
 	}
-	// create request message
-	request := MakeKeyRequestMessage(keyHSM, hsmrequest.Code, keyForHSM)
-	if err != nil {
-		return resGetKey{key: []byte{}, err: fmt.Errorf("error creating request to HSM client: %v", err)}
+
+	// the first time we talk to this HSM client, we check if it supports the framed protocol
+	// (cf protocol.go). a legacy HSM client may have closed the connexion, so we open a new one.
+	protocol := protocolFor(hsm_client_addr)
+	if protocol == PROTOCOL_AUTO {
+		protocol, err = negotiateProtocol(ctx, conn)
+		if err != nil {
+			return resGetKey{key: []byte{}, err: fmt.Errorf("error sending request to HSM client: %w", err)}
+		}
+		rememberProtocol(hsm_client_addr, protocol)
+		if protocol == PROTOCOL_LEGACY {
+			conn.Close()
+			conn, err = dial(ctx, hsm_client_addr)
+			if err != nil {
+				return resGetKey{key: []byte{}, err: fmt.Errorf("error sending request to HSM client: %w", err)}
+			}
+		}
 	}
 
-	// send a key request to HSM client to retrieve key at a given index on the given HSM
-	key, err := SendKeyRequest(conn, keyHSM, request, hsmrequest.Size)
+	var key []byte
+	if protocol == PROTOCOL_FRAMED {
+		key, err = sendWithContext(ctx, conn, keyHSM, func() ([]byte, error) {
+			return sendFramedKeyRequest(conn, keyHSM, hsmrequest, keyForHSM)
+		})
+	} else {
+		// create request message
+		request := MakeKeyRequestMessage(keyHSM, hsmrequest.Code, keyForHSM)
+
+		// send a key request to HSM client to retrieve key at a given index on the given HSM
+		key, err = SendKeyRequestContext(ctx, conn, keyHSM, request, hsmrequest.Size)
+	}
 	if err != nil {
-		return resGetKey{key: []byte{}, err: fmt.Errorf("error sending request to HSM client: %v", err)}
+		return resGetKey{key: []byte{}, err: fmt.Errorf("error sending request to HSM client: %w", err)}
 	}
 	return resGetKey{key: key, err: nil}
 }
 
-// sends 2 parallel requests to 2 HSM to retrieve a key at a given index.
-// parameters : HSM client address, 2 keys (reference by their HSM and index)
-// returns the key or an empty byte slice if the request failed for both goroutines
-// (in this case, the error will be printed)
-func GetKey(hsm_client_addr string, keyHSM_1 KeyHSM, keyHSM_2 KeyHSM, action string, keyForHSM []byte) []byte {
-	// channel to retrieve HSM request results (key + eventual error)
-	return_values := make(chan resGetKey, 2)
-
-	// make 2 parallel requests
-	go func() {
-		return_values <- GetKeyFromHSM(hsm_client_addr, keyHSM_1, action, keyForHSM)
-	}()
-	go func() {
-		return_values <- GetKeyFromHSM(hsm_client_addr, keyHSM_2, action, keyForHSM)
-	}()
+// sends requests to the HSM holding the replicas of a key, to retrieve it.
+// parameters : HSM client address (used for the replicas without Addresses),
+// replicas of the key (referenced by their HSM and index, cf Replicas)
+// returns the key, or an error joining the failures if the request failed on every HSM
+// (the errors can be tested with errors.Is, cf errors.go)
+func GetKey(hsm_client_addr string, replicas []Replica, action string, keyForHSM []byte) ([]byte, error) {
+	return GetKeyContext(context.Background(), hsm_client_addr, replicas, action, keyForHSM)
+}
 
-	key := []byte{}
-	// return values
-	for range 2 {
-
-		res := <-return_values
-		// if the first goroutine to finish returns an error,
-		// print the error and continue
-		if res.err != nil {
-			// don't print this error as if one request succeed we can't ignore the other error
-			// we'll only print it if both requests fail
-			// log.Println(res.err)
-			continue
-		} else {
-			// else : a key was returned
-			key = res.key
-			break
-		}
-	}
-	return key
+// same as GetKey, but the requests are cancelled when the context is done.
+// if the context has no deadline, DEFAULT_REQUEST_TIMEOUT is applied.
+// the requests still running when GetKeyContext returns are cancelled.
+// (the HSM are queried with POLICY_FIRST_SUCCESS, HSMClient.GetKey supports the other policies)
+func GetKeyContext(ctx context.Context, hsm_client_addr string, replicas []Replica, action string, keyForHSM []byte) ([]byte, error) {
+	return getKeyWithPolicy(ctx, POLICY_FIRST_SUCCESS, 0, replicas, func(ctx context.Context, replica Replica) resGetKey {
+		return defaultFailover.getKey(ctx, hsm_client_addr, replica, func(ctx context.Context, hsm_client_addr string, keyHSM KeyHSM) ([]byte, error) {
+			res := GetKeyFromHSMContext(ctx, hsm_client_addr, keyHSM, action, keyForHSM)
+			return res.key, res.err
+		})
+	})
 }
@@ -0,0 +1,119 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+// wraps a data key into a ck and unwraps it, with or without context,
+// through the package functions (one connexion per request) and through an HSMClient
+func TestCreateCkGetKFromCK(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	replicas := Replicas(KeyHSM{17, 1}, KeyHSM{22, 1})
+	object := []byte("bucket/key")
+
+	for _, protocol := range []Protocol{PROTOCOL_AUTO, PROTOCOL_LEGACY, PROTOCOL_FRAMED} {
+		setTestProtocol(t, protocol)
+		c := newTestClient(t, HSMClientOptions{})
+		clients := map[string]func(ctx context.Context, action string, payload []byte) ([]byte, error){
+			"GetKeyContext": func(ctx context.Context, action string, payload []byte) ([]byte, error) {
+				return GetKeyContext(ctx, addr, replicas, action, payload)
+			},
+			"HSMClient": func(ctx context.Context, action string, payload []byte) ([]byte, error) {
+				return c.GetKey(ctx, addr, replicas, action, payload)
+			},
+		}
+		for name, getKey := range clients {
+			ctx := context.Background()
+			k := testDataKey(byte(protocol) + 1)
+
+			ck, err := getKey(ctx, "CreateCk", k)
+			if err != nil {
+				t.Fatalf("%s %s CreateCk: %v", name, protocol, err)
+			}
+			if len(ck) != 48 {
+				t.Fatalf("%s %s: ck of %d bytes", name, protocol, len(ck))
+			}
+			got, err := getKey(ctx, "GetKFromCK", ck)
+			if err != nil || !bytes.Equal(got, k) {
+				t.Fatalf("%s %s GetKFromCK: got %x (%v), want %x", name, protocol, got, err, k)
+			}
+
+			payload, _ := ContextPayload(k, object)
+			ckCtx, err := getKey(ctx, "CreateCkCtx", payload)
+			if err != nil {
+				t.Fatalf("%s %s CreateCkCtx: %v", name, protocol, err)
+			}
+			payload, _ = ContextPayload(ckCtx, object)
+			got, err = getKey(ctx, "GetKFromCKCtx", payload)
+			if err != nil || !bytes.Equal(got, k) {
+				t.Fatalf("%s %s GetKFromCKCtx: got %x (%v), want %x", name, protocol, got, err, k)
+			}
+
+			// the ck is only unwrapped with the context it is bound to
+			payload, _ = ContextPayload(ckCtx, []byte("bucket/other"))
+			if _, err := getKey(ctx, "GetKFromCKCtx", payload); !errors.Is(err, ErrBadRequest) {
+				t.Fatalf("%s %s: ck unwrapped with another context (%v)", name, protocol, err)
+			}
+			if _, err := getKey(ctx, "GetKFromCK", ckCtx); !errors.Is(err, ErrBadRequest) {
+				t.Fatalf("%s %s: ck bound to a context unwrapped without it (%v)", name, protocol, err)
+			}
+		}
+	}
+}
+
+func TestGetKeyStatusErrors(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{})
+	c := newTestClient(t, HSMClientOptions{MaxRetries: -1})
+	ctx := context.Background()
+
+	// the index doesn't exist on the keystore
+	_, err := c.GetKey(ctx, addr, Replicas(KeyHSM{17, KEY_INDEXES_PER_HSM - 1}), "CreateCk", testDataKey(1))
+	if err != nil {
+		t.Fatalf("CreateCk at the last index: %v", err)
+	}
+	_, err = c.GetKeyFromHSM(ctx, addr, KeyHSM{17, KEY_INDEXES_PER_HSM}, "CreateCk", testDataKey(1))
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got %v, want ErrKeyNotFound", err)
+	}
+
+	server.SetFault(17, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_ERROR, Status: STATUS_HSM_UNAVAILABLE})
+	_, err = c.GetKey(ctx, addr, Replicas(KeyHSM{17, 1}), "CreateCk", testDataKey(1))
+	var hsmErr *HSMError
+	if !errors.Is(err, ErrHSMUnavailable) || !errors.As(err, &hsmErr) || hsmErr.KeyHSM.Hsm_number != 17 {
+		t.Fatalf("got %v, want an HSMError of HSM 17 wrapping ErrHSMUnavailable", err)
+	}
+
+	_, err = c.GetKey(ctx, addr, Replicas(KeyHSM{17, 1}), "unknown", nil)
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("got %v, want ErrBadRequest", err)
+	}
+}
+
+func TestReplicaValidate(t *testing.T) {
+	valid := []Replica{
+		{KeyHSM: KeyHSM{17, 1}},
+		{KeyHSM: KeyHSM{255, KEY_INDEXES_PER_HSM - 1}, Priority: 0, Weight: 0, Addresses: []string{"localhost:6123"}},
+	}
+	for _, replica := range valid {
+		if err := replica.Validate(); err != nil {
+			t.Errorf("%+v: %v", replica, err)
+		}
+	}
+	invalid := []Replica{
+		{KeyHSM: KeyHSM{256, 1}},
+		{KeyHSM: KeyHSM{17, KEY_INDEXES_PER_HSM}},
+		{KeyHSM: KeyHSM{17, 1}, Priority: -1},
+		{KeyHSM: KeyHSM{17, 1}, Weight: -1},
+		{KeyHSM: KeyHSM{17, 1}, Addresses: []string{"no port"}},
+	}
+	for _, replica := range invalid {
+		if err := replica.Validate(); err == nil {
+			t.Errorf("%+v accepted", replica)
+		}
+	}
+}
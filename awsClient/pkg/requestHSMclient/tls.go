@@ -0,0 +1,59 @@
+package requestHSMclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// files and names used to secure the connexions to the HSM client with TLS
+type TLSOptions struct {
+	CAFile     string // PEM bundle of the CAs trusted to sign the HSM client certificate (system CAs if empty)
+	CertFile   string // PEM certificate presented to the HSM client (mutual TLS), optional
+	KeyFile    string // PEM private key of CertFile
+	ServerName string // name expected in the HSM client certificate (host of the address if empty)
+}
+
+// builds the TLS configuration used to dial the HSM client
+func LoadTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: options.ServerName,
+	}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading HSM client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in HSM client CA bundle %s", options.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, fmt.Errorf("the client certificate and its key must be given together")
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate for the HSM client: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// connect to HSM client with TLS (the handshake is done before returning).
+// if tlsConfig has no ServerName, the host of the address is used.
+func ConnectHSMClientTLS(ctx context.Context, hsm_client_addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", hsm_client_addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error connecting to HSM client %s with TLS: %w", ErrHSMUnavailable, hsm_client_addr, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,274 @@
+package requestHSMclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"math/big"
+	"slices"
+)
+
+/*
+	Threshold PRF (TPRF) : the data key of an object is derived from a PRF evaluated
+	jointly by the keystores, none of which holds the whole PRF key.
+
+	The PRF key s is shared between the keystores with a Shamir secret sharing of threshold t :
+	the keystore i holds s_i = f(i), where f is a polynomial of degree t-1 with f(0) = s
+	(the x-coordinate of a share is the HSM number, which can't be 0).
+	The PRF is F(x) = H(x)^s in the group of the quadratic residues modulo the 2048 bits
+	prime of RFC 3526, where H hashes x into the group.
+
+	To evaluate F(x), the client :
+	- blinds the input : a = H(x)^r with a random r, so that the keystores don't learn x
+	- sends a to t keystores, each one answers b_i = a^s_i (action "EvalTPRF").
+	  if a keystore fails, the next replica is queried instead (in the order of orderReplicas)
+	- unblinds the answers : y_i = b_i^(1/r) = H(x)^s_i
+	- combines them with a Lagrange interpolation in the exponent : F(x) = prod(y_i^l_i) = H(x)^s
+	The data key is SHA-256(F(x)). Any t keystores give the same key : the key can
+	still be derived when n-t of the n replicas are unavailable.
+
+	A key used for encryption must be derivable again, or the object is lost. A keystore returning
+	a wrong evaluation, or keystores whose sharing has a higher degree than t-1 (threshold of the
+	client lower than the one of the keystores), still give a valid group element, but another
+	subset of keystores would give another key. DeriveKeyTPRFVerified therefore asks t+1 keystores,
+	and checks that two different subsets of t evaluations give the same F(x) : this holds if and
+	only if the t+1 evaluations lie on a polynomial of degree t-1.
+	All the replicas must use the same key index, which selects the sharing on the keystores.
+*/
+
+// size of a group element in the requests and answers
+const TPRF_ELEMENT_SIZE = 256
+
+// prime of the 2048 bits MODP group of RFC 3526 (p = 2q+1, q prime)
+const TPRF_PRIME = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var (
+	tprfP = mustParsePrime(TPRF_PRIME)
+	tprfQ = new(big.Int).Rsh(tprfP, 1) // order of the group of the quadratic residues
+)
+
+func mustParsePrime(hexPrime string) *big.Int {
+	p, ok := new(big.Int).SetString(hexPrime, 16)
+	if !ok {
+		panic("invalid TPRF prime")
+	}
+	return p
+}
+
+// hashes the input into the group : the hash, expanded to 2304 bits and reduced modulo p, is squared
+func hashToGroup(input []byte) *big.Int {
+	expanded := make([]byte, 0, 9*sha256.Size)
+	for counter := uint32(0); counter < 9; counter++ {
+		h := sha256.New()
+		h.Write([]byte("TPRF hash to group"))
+		h.Write(binary.BigEndian.AppendUint32(nil, counter))
+		h.Write(input)
+		expanded = h.Sum(expanded)
+	}
+	e := new(big.Int).SetBytes(expanded)
+	e.Mod(e, tprfP)
+	return e.Exp(e, big.NewInt(2), tprfP)
+}
+
+// decodes a group element, and checks that it is a quadratic residue other than 1
+func decodeElement(b []byte) (*big.Int, error) {
+	if len(b) != TPRF_ELEMENT_SIZE {
+		return nil, fmt.Errorf("invalid TPRF element of %d bytes", len(b))
+	}
+	e := new(big.Int).SetBytes(b)
+	if e.Cmp(big.NewInt(1)) <= 0 || e.Cmp(tprfP) >= 0 || new(big.Int).Exp(e, tprfQ, tprfP).Cmp(big.NewInt(1)) != 0 {
+		return nil, fmt.Errorf("invalid TPRF element")
+	}
+	return e, nil
+}
+
+// checks the replicas and the threshold of a TPRF evaluation
+func validateTPRF(replicas []Replica, threshold int) error {
+	if threshold < 1 || threshold > len(replicas) {
+		return fmt.Errorf("%w: TPRF threshold %d with %d replicas", ErrBadRequest, threshold, len(replicas))
+	}
+	seen := map[int]bool{}
+	for _, replica := range replicas {
+		if replica.Key_index != replicas[0].Key_index {
+			// each keystore derives its share from the index : the shares of different indexes don't combine
+			return fmt.Errorf("%w: the TPRF replicas use different key indexes (%d on HSM %d, %d on HSM %d)", ErrBadRequest,
+				replicas[0].Key_index, replicas[0].Hsm_number, replica.Key_index, replica.Hsm_number)
+		}
+		if replica.Hsm_number == 0 {
+			// the share of x-coordinate 0 would be the PRF key itself
+			return fmt.Errorf("%w: HSM 0 can't hold a TPRF share", ErrBadRequest)
+		}
+		if seen[replica.Hsm_number] {
+			return fmt.Errorf("%w: several replicas on HSM %d for the TPRF", ErrBadRequest, replica.Hsm_number)
+		}
+		seen[replica.Hsm_number] = true
+	}
+	return nil
+}
+
+// Lagrange interpolation at 0 in the exponent : combines the evaluations H(x)^s_i
+// of the HSM numbers i into H(x)^s
+func combineTPRF(evaluations map[int]*big.Int) *big.Int {
+	y := big.NewInt(1)
+	for i, yi := range evaluations {
+		num, den := big.NewInt(1), big.NewInt(1)
+		for j := range evaluations {
+			if j == i {
+				continue
+			}
+			num.Mul(num, big.NewInt(int64(j)))
+			num.Mod(num, tprfQ)
+			den.Mul(den, big.NewInt(int64(j-i)))
+			den.Mod(den, tprfQ)
+		}
+		lambda := num.Mul(num, den.ModInverse(den, tprfQ))
+		lambda.Mod(lambda, tprfQ)
+		y.Mul(y, new(big.Int).Exp(yi, lambda, tprfP))
+		y.Mod(y, tprfP)
+	}
+	return y
+}
+
+// evaluates the TPRF on the input with threshold replicas, and returns the 32 bytes data key.
+// parameters : HSM client address (used for the replicas without Addresses), replicas holding
+// the shares (at least threshold, on distinct HSM other than 0, with the same key index),
+// threshold of the sharing, input
+// returns an error wrapping ErrThreshold if less than threshold HSM answered
+func (c *HSMClient) DeriveKeyTPRF(ctx context.Context, hsm_client_addr string, replicas []Replica, threshold int, input []byte) ([]byte, error) {
+	return deriveKeyTPRF(ctx, replicas, threshold, false, input, c.evaluateTPRF(hsm_client_addr))
+}
+
+// same as DeriveKeyTPRF, but threshold+1 HSM are queried to check that the key can be derived
+// again by other subsets of threshold HSM. to be used for a key that encrypts an object.
+// returns an error wrapping ErrThreshold if less than threshold+1 HSM answered,
+// and an error wrapping ErrKeyMismatch if the evaluations are inconsistent
+func (c *HSMClient) DeriveKeyTPRFVerified(ctx context.Context, hsm_client_addr string, replicas []Replica, threshold int, input []byte) ([]byte, error) {
+	return deriveKeyTPRF(ctx, replicas, threshold, true, input, c.evaluateTPRF(hsm_client_addr))
+}
+
+// partial evaluation of the TPRF by a replica, through the pooled connexions and the failover of the client
+func (c *HSMClient) evaluateTPRF(hsm_client_addr string) func(context.Context, Replica, []byte) resGetKey {
+	return func(ctx context.Context, replica Replica, blinded []byte) resGetKey {
+		return c.failover.getKey(ctx, hsm_client_addr, replica, func(ctx context.Context, hsm_client_addr string, keyHSM KeyHSM) ([]byte, error) {
+			return c.GetKeyFromHSM(ctx, hsm_client_addr, keyHSM, "EvalTPRF", blinded)
+		})
+	}
+}
+
+func deriveKeyTPRF(ctx context.Context, replicas []Replica, threshold int, verify bool, input []byte, evaluate func(context.Context, Replica, []byte) resGetKey) ([]byte, error) {
+	if err := validateTPRF(replicas, threshold); err != nil {
+		return []byte{}, err
+	}
+	// number of evaluations needed
+	needed := threshold
+	if verify {
+		needed++
+		if needed > len(replicas) {
+			return []byte{}, fmt.Errorf("%w: checking the TPRF key needs %d replicas, got %d", ErrBadRequest, needed, len(replicas))
+		}
+	}
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); ok {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, DEFAULT_REQUEST_TIMEOUT)
+	}
+	// cancels the requests still running when we return
+	defer cancel()
+
+	// blinding : the HSM evaluate the PRF on H(x)^r
+	r, err := rand.Int(rand.Reader, new(big.Int).Sub(tprfQ, big.NewInt(1)))
+	if err != nil {
+		return []byte{}, fmt.Errorf("couldn't blind the TPRF input: %w", err)
+	}
+	r.Add(r, big.NewInt(1))
+	rInv := new(big.Int).ModInverse(r, tprfQ)
+	blinded := new(big.Int).Exp(hashToGroup(input), r, tprfP).FillBytes(make([]byte, TPRF_ELEMENT_SIZE))
+
+	type result struct {
+		replica Replica
+		resGetKey
+	}
+	queue := slices.Concat(orderReplicas(replicas)...)
+	return_values := make(chan result, len(queue))
+	started, pending := 0, 0
+	startNext := func() {
+		replica := queue[started]
+		started++
+		pending++
+		go func() {
+			return_values <- result{replica, evaluate(ctx, replica, blinded)}
+		}()
+	}
+	for range needed {
+		startNext()
+	}
+
+	evaluations := map[int]*big.Int{}
+	errs := []error{}
+	for pending > 0 && len(evaluations) < needed {
+		res := <-return_values
+		pending--
+		if res.err == nil {
+			var b *big.Int
+			b, res.err = decodeElement(res.key)
+			if res.err == nil {
+				// unblinding : (H(x)^(r.s_i))^(1/r) = H(x)^s_i
+				evaluations[res.replica.Hsm_number] = b.Exp(b, rInv, tprfP)
+				continue
+			}
+			res.err = fmt.Errorf("HSM %d: %w", res.replica.Hsm_number, res.err)
+		}
+		errs = append(errs, res.err)
+		// another replica replaces the one that failed
+		if started < len(queue) && ctx.Err() == nil {
+			startNext()
+		}
+	}
+	if len(evaluations) < needed {
+		return []byte{}, fmt.Errorf("%w: TPRF evaluation needs %d HSM, %d answered: %w", ErrThreshold, needed, len(evaluations), errors.Join(errs...))
+	}
+
+	var y *big.Int
+	if verify {
+		y, err = checkTPRF(evaluations)
+		if err != nil {
+			return []byte{}, err
+		}
+	} else {
+		y = combineTPRF(evaluations)
+	}
+	key := sha256.Sum256(y.FillBytes(make([]byte, TPRF_ELEMENT_SIZE)))
+	return key[:], nil
+}
+
+// combines threshold+1 evaluations : the subsets without the smallest and without the largest
+// HSM number must give the same F(x), which is returned
+func checkTPRF(evaluations map[int]*big.Int) (*big.Int, error) {
+	numbers := slices.Sorted(maps.Keys(evaluations))
+	without := func(excluded int) map[int]*big.Int {
+		subset := maps.Clone(evaluations)
+		delete(subset, excluded)
+		return subset
+	}
+	first, last := numbers[0], numbers[len(numbers)-1]
+	y := combineTPRF(without(first))
+	if y.Cmp(combineTPRF(without(last))) != 0 {
+		return nil, fmt.Errorf("%w: the TPRF evaluations of HSM %v are inconsistent (a keystore answered a wrong evaluation, or the threshold isn't the one of the keystores)", ErrKeyMismatch, numbers)
+	}
+	return y, nil
+}
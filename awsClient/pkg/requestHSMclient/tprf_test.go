@@ -0,0 +1,130 @@
+package requestHSMclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"awsClient/pkg/mockHSMclient"
+)
+
+func TestValidateTPRF(t *testing.T) {
+	tests := []struct {
+		replicas  []Replica
+		threshold int
+		ok        bool
+	}{
+		{Replicas(KeyHSM{1, 4}, KeyHSM{2, 4}), 2, true},
+		{Replicas(KeyHSM{1, 4}, KeyHSM{2, 4}), 3, false},
+		{Replicas(KeyHSM{1, 4}, KeyHSM{2, 4}), 0, false},
+		{Replicas(KeyHSM{1, 4}, KeyHSM{2, 5}), 1, false}, // different key indexes
+		{Replicas(KeyHSM{0, 4}, KeyHSM{2, 4}), 1, false}, // HSM 0
+		{Replicas(KeyHSM{1, 4}, KeyHSM{1, 4}), 1, false}, // same HSM twice
+	}
+	for _, test := range tests {
+		err := validateTPRF(test.replicas, test.threshold)
+		if (err == nil) != test.ok || (err != nil && !errors.Is(err, ErrBadRequest)) {
+			t.Errorf("validateTPRF(%v, %d) = %v", test.replicas, test.threshold, err)
+		}
+	}
+}
+
+// the verified derivation gives the key that any other subset of threshold keystores gives later
+func TestDeriveKeyTPRF(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{TPRFThreshold: 2})
+	c := newTestClient(t, HSMClientOptions{MaxRetries: -1})
+	replicas := Replicas(KeyHSM{1, 3}, KeyHSM{2, 3}, KeyHSM{3, 3}, KeyHSM{4, 3})
+	input := []byte("bucket/key")
+
+	key, err := c.DeriveKeyTPRFVerified(context.Background(), addr, replicas, 2, input)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("DeriveKeyTPRFVerified: %x, %v", key, err)
+	}
+	for _, pair := range [][2]int{{1, 2}, {3, 4}, {1, 4}, {2, 3}} {
+		subset := Replicas(KeyHSM{pair[0], 3}, KeyHSM{pair[1], 3})
+		got, err := c.DeriveKeyTPRF(context.Background(), addr, subset, 2, input)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Fatalf("keystores %v: %x, %v, want %x", pair, got, err, key)
+		}
+	}
+
+	// the failed keystores are replaced by the other replicas
+	server.SetFault(1, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_ERROR, Status: 4})
+	got, err := c.DeriveKeyTPRFVerified(context.Background(), addr, replicas, 2, input)
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("with HSM 1 down: %x, %v, want %x", got, err, key)
+	}
+	server.SetFault(2, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_ERROR, Status: 4})
+	if _, err := c.DeriveKeyTPRFVerified(context.Background(), addr, replicas, 2, input); !errors.Is(err, ErrThreshold) {
+		t.Fatalf("got %v with 2 HSM down, want ErrThreshold", err)
+	}
+	got, err = c.DeriveKeyTPRF(context.Background(), addr, replicas, 2, input)
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("decryption with 2 HSM down: %x, %v, want %x", got, err, key)
+	}
+
+	// another input, or another index, gives another key
+	other, err := c.DeriveKeyTPRF(context.Background(), addr, Replicas(KeyHSM{3, 3}, KeyHSM{4, 3}), 2, []byte("bucket/other"))
+	if err != nil || bytes.Equal(other, key) {
+		t.Fatalf("same key for another input (%v)", err)
+	}
+	other, err = c.DeriveKeyTPRF(context.Background(), addr, Replicas(KeyHSM{3, 4}, KeyHSM{4, 4}), 2, input)
+	if err != nil || bytes.Equal(other, key) {
+		t.Fatalf("same key for another index (%v)", err)
+	}
+}
+
+func TestDeriveKeyTPRFVerifiedNeedsMoreReplicas(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{})
+	c := newTestClient(t, HSMClientOptions{})
+	_, err := c.DeriveKeyTPRFVerified(context.Background(), addr, Replicas(KeyHSM{1, 3}, KeyHSM{2, 3}), 2, []byte("x"))
+	if !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("got %v, want ErrBadRequest", err)
+	}
+}
+
+// a client threshold lower than the one of the keystores gives keys that other subsets can't derive
+func TestDeriveKeyTPRFThresholdMismatch(t *testing.T) {
+	_, addr := startMock(t, mockHSMclient.Options{TPRFThreshold: 3})
+	c := newTestClient(t, HSMClientOptions{})
+	replicas := Replicas(KeyHSM{1, 3}, KeyHSM{2, 3}, KeyHSM{3, 3}, KeyHSM{4, 3})
+	_, err := c.DeriveKeyTPRFVerified(context.Background(), addr, replicas, 2, []byte("x"))
+	if !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("got %v, want ErrKeyMismatch", err)
+	}
+	// with the threshold of the keystores, the key is checked
+	if _, err := c.DeriveKeyTPRFVerified(context.Background(), addr, replicas, 3, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a keystore answering a wrong evaluation never gives a key
+func TestDeriveKeyTPRFCorruptShare(t *testing.T) {
+	server, addr := startMock(t, mockHSMclient.Options{})
+	c := newTestClient(t, HSMClientOptions{MaxRetries: -1})
+	replicas := Replicas(KeyHSM{1, 3}, KeyHSM{2, 3}, KeyHSM{3, 3})
+	evaluate := c.evaluateTPRF(addr)
+	corrupt := func(ctx context.Context, replica Replica, blinded []byte) resGetKey {
+		res := evaluate(ctx, replica, blinded)
+		if res.err == nil && replica.Hsm_number == 2 {
+			// b^2 is still a quadratic residue
+			b := new(big.Int).SetBytes(res.key)
+			res.key = b.Exp(b, big.NewInt(2), tprfP).FillBytes(make([]byte, TPRF_ELEMENT_SIZE))
+		}
+		return res
+	}
+	if _, err := deriveKeyTPRF(context.Background(), replicas, 2, true, []byte("x"), corrupt); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("got %v, want ErrKeyMismatch", err)
+	}
+
+	// the flipped bytes of the answer are rejected as an invalid element, or give a wrong one
+	server.SetFault(2, mockHSMclient.Fault{Kind: mockHSMclient.FAULT_CORRUPT})
+	for range 10 {
+		_, err := c.DeriveKeyTPRFVerified(context.Background(), addr, replicas, 2, []byte("x"))
+		if !errors.Is(err, ErrThreshold) && !errors.Is(err, ErrKeyMismatch) {
+			t.Fatalf("got %v with a corrupt answer, want ErrThreshold or ErrKeyMismatch", err)
+		}
+	}
+}